@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/validator"
+)
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string           `json:"name"`
+		Permissions data.Permissions `json:"permissions"`
+		Expiry      *time.Time       `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	//A key can only be given permissions that the user has themselves
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := data.NewAPIKey(user.ID, input.Name, input.Permissions, input.Expiry)
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key, permissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.APIKeys.Insert(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/users/me/api-keys/%d", key.ID))
+
+	//This is the only time the plaintext key is ever sent to the client
+	err = app.writeJSON(w, http.StatusCreated, envelop{"api_key": key}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.APIKeys.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "API key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache is a small in-process cache whose entries expire after a fixed time. It is meant for
+// short-lived caching of hot, cheap-to-recompute results, so when it fills up the expired entries
+// are dropped and, if that isn't enough, the whole cache is cleared.
+type ttlCache[V any] struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]ttlCacheEntry[V]
+}
+
+type ttlCacheEntry[V any] struct {
+	value  V
+	expiry time.Time
+}
+
+func newTTLCache[V any](ttl time.Duration, maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]ttlCacheEntry[V]),
+	}
+}
+
+// Get() returns the cached value for the key, if there is one which hasn't expired.
+func (c *ttlCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiry) {
+		var zero V
+		return zero, false
+	}
+
+	return entry.value, true
+}
+
+func (c *ttlCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	if len(c.entries) >= c.maxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expiry) {
+				delete(c.entries, k)
+			}
+		}
+
+		if len(c.entries) >= c.maxEntries {
+			clear(c.entries)
+		}
+	}
+
+	c.entries[key] = ttlCacheEntry[V]{value: value, expiry: now.Add(c.ttl)}
+}
+
+// Clear() removes all entries, for when the underlying data has changed.
+func (c *ttlCache[V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/arynkh/greenlight/internal/data"
+)
+
+// Define a custom contextKey type, with the underlying type string
+type contextKey string
+
+// Convert the string "user" to a contextKey type and assign it to the userContextKey constant.
+// We'll use this constant as the key for getting and setting user information in the request context
+const userContextKey = contextKey("user")
+
+// The tokenContextKey is used to store the bearer token which authenticated the request, so that
+// handlers can act on the current session (for example, to revoke it).
+const tokenContextKey = contextKey("token")
+
+// The apiKeyContextKey is used to store the API key which authenticated the request, if any.
+const apiKeyContextKey = contextKey("apiKey")
+
+// The contextSetUser() method returns a new copy of the request with the provided User struct added
+// to the context. Note that we use our userContextKey constant as the key
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// The contextGetUser() retrieves the User struct from the request context. The only time that we'll
+// use this helper is when we logically expect there to be User struct value in the context, and if
+// it doesn't exist it will firmly be an 'unexpected' error, so it's OK to panic
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
+
+// The contextSetToken() method returns a new copy of the request with the bearer token added to
+// the context.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() retrieves the bearer token from the request context. It returns the empty
+// string for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetAPIKey() method returns a new copy of the request with the API key added to the
+// context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() retrieves the API key from the request context. It returns nil if the
+// request wasn't authenticated with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
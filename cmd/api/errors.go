@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -60,7 +63,71 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since you last fetched it, please fetch it again and retry"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request must include an If-Match header with the resource's ETag"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
+
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, lockedUntil time.Time) {
+	//Tell the client how many seconds to wait before trying again
+	retryAfter := int(math.Ceil(time.Until(lockedUntil).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	//Let the client know that we expect them to authenticate using a bearer token
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid, expired or missing API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) ambiguousCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "send either an API key or an authentication token, not both"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must be activated to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid, expired or revoked refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/arynkh/greenlight/internal/data"
+)
+
+// movieETag() returns the strong ETag for the full representation of a movie. The version number
+// is incremented on every update, so the ETag changes whenever the movie does.
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d-%d"`, movie.ID, movie.Version)
+}
+
+// etagMatches() reports whether an If-Match or If-None-Match header value matches the given ETag.
+// If-None-Match uses the weak comparison, where W/ prefixes are ignored, and If-Match uses the
+// strong comparison, where weak ETags never match.
+func etagMatches(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for candidate := range strings.SplitSeq(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified() checks the If-None-Match header of a request against the ETag of the response.
+// If they match, it sends a 304 Not Modified response and returns true.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !etagMatches(header, etag, true) {
+		return false
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checkIfMatch() checks the If-Match header of a request which changes a resource against the
+// resource's current ETag, so that clients don't overwrite changes they haven't seen. If the
+// request shouldn't go ahead it sends an error response and returns false. It also returns
+// whether an If-Match header was provided.
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) (ok, provided bool) {
+	header := r.Header.Get("If-Match")
+
+	if header == "" {
+		if app.config.requireIfMatch {
+			app.preconditionRequiredResponse(w, r)
+			return false, false
+		}
+		return true, false
+	}
+
+	if !etagMatches(header, etag, false) {
+		app.preconditionFailedResponse(w, r)
+		return false, true
+	}
+
+	return true, true
+}
+
+// writeJSONWithETag() sends a JSON response like writeJSON(), along with a weak ETag calculated
+// from a hash of the response data. If the client already has the same data, as shown by its
+// If-None-Match header, a 304 Not Modified response is sent instead.
+func (app *application) writeJSONWithETag(w http.ResponseWriter, r *http.Request, status int, data envelop, headers http.Header) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(js)
+	etag := fmt.Sprintf(`W/"%x"`, sum[:16])
+
+	if app.notModified(w, r, etag) {
+		return nil
+	}
+
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set("ETag", etag)
+
+	return app.writeJSON(w, status, data, headers)
+}
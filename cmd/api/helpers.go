@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/arynkh/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
@@ -148,6 +149,27 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readTime() helper reads a timestamp from the query string, either in RFC 3339 format or as a
+// plain date (which is taken as midnight UTC), and returns the zero time if it isn't present.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, s)
+		if err != nil {
+			v.AddError(key, "must be a date (2006-01-02) or an RFC 3339 timestamp")
+			return time.Time{}
+		}
+	}
+
+	return t
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 // Run a deferred function which uses recover() to catch any panic, and log an error message instead
 // of terminating the application
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/jwt"
+)
+
+// parseJWTKeys() parses the -jwt-keys setting, which is a comma-separated list of keys in
+// "kid:key" format. For HS256 the key is the shared secret itself and must be at least 32 bytes
+// long. For EdDSA the key is a base64-encoded 32-byte Ed25519 seed.
+func parseJWTKeys(algorithm, spec string) (jwt.KeySet, error) {
+	if spec == "" {
+		return nil, errors.New("at least one JWT key must be provided in jwt auth mode")
+	}
+
+	var keys jwt.KeySet
+
+	for item := range strings.SplitSeq(spec, ",") {
+		kid, value, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found || kid == "" || value == "" {
+			return nil, fmt.Errorf("invalid JWT key %q: must be in kid:key format", item)
+		}
+
+		key := jwt.Key{ID: kid, Algorithm: algorithm}
+
+		switch algorithm {
+		case jwt.HS256:
+			if len(value) < 32 {
+				return nil, fmt.Errorf("invalid JWT key %q: HS256 secrets must be at least 32 bytes long", kid)
+			}
+			key.Material = []byte(value)
+		case jwt.EdDSA:
+			seed, err := base64.StdEncoding.DecodeString(value)
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, fmt.Errorf("invalid JWT key %q: EdDSA keys must be a base64-encoded 32-byte seed", kid)
+			}
+			key.Material = ed25519.NewKeyFromSeed(seed)
+		default:
+			return nil, fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// createJWT() issues a signed access token for the user using the current signing key.
+func (app *application) createJWT(user *data.User) (*data.Token, error) {
+	now := time.Now()
+	expiry := now.Add(app.config.jwt.ttl)
+
+	claims := jwt.Claims{
+		Issuer:    app.config.jwt.issuer,
+		Subject:   strconv.FormatInt(user.ID, 10),
+		Audience:  jwt.Audience{app.config.jwt.audience},
+		Expiry:    expiry.Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+	}
+
+	signed, err := jwt.Sign(app.jwtKeys[0], claims)
+	if err != nil {
+		return nil, err
+	}
+
+	//Return the JWT in a Token struct so that the response has the same shape as a stateful token
+	return &data.Token{Plaintext: signed, UserID: user.ID, Expiry: expiry, Scope: data.ScopeAuthentication}, nil
+}
+
+// userForJWT() verifies the signature, expiry, issuer and audience of a JWT and then loads the
+// user it was issued to. Any problem with the token itself is reported as data.ErrRecordNotFound
+// so that callers can treat it the same way as an unknown stateful token.
+func (app *application) userForJWT(token string) (*data.User, error) {
+	var claims jwt.Claims
+
+	err := jwt.Verify(token, app.jwtKeys, &claims)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	err = claims.Validate(app.config.jwt.issuer, app.config.jwt.audience, time.Now())
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	//Tokens issued before the user last signed out everywhere are rejected here
+	return app.models.Users.GetForJWT(userID, time.Unix(claims.IssuedAt, 0))
+}
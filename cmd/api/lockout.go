@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/data"
+	"github.com/tomasen/realip"
+)
+
+// loginLockedUntil() returns the time until which logins are blocked for the email address or the
+// client IP, whichever is later. It returns the zero time if neither is locked.
+func (app *application) loginLockedUntil(email, ip string) (time.Time, error) {
+	emailLockedUntil, err := app.models.LoginFailures.LockedUntil(data.LoginFailureKeyEmail(email))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ipLockedUntil, err := app.models.LoginFailures.LockedUntil(data.LoginFailureKeyIP(ip))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if ipLockedUntil.After(emailLockedUntil) {
+		return ipLockedUntil, nil
+	}
+
+	return emailLockedUntil, nil
+}
+
+// recordLoginFailure() counts a failed login attempt against the email address and client IP. If
+// this locks the account of an existing user, they are sent an email to let them know.
+func (app *application) recordLoginFailure(user *data.User, email, ip string) error {
+	policy := data.LockoutPolicy{
+		BaseDuration: app.config.lockout.baseDuration,
+		MaxDuration:  app.config.lockout.maxDuration,
+	}
+
+	policy.Threshold = app.config.lockout.ipThreshold
+
+	_, err := app.models.LoginFailures.RecordFailure(data.LoginFailureKeyIP(ip), policy)
+	if err != nil {
+		return err
+	}
+
+	policy.Threshold = app.config.lockout.emailThreshold
+
+	locked, err := app.models.LoginFailures.RecordFailure(data.LoginFailureKeyEmail(email), policy)
+	if err != nil {
+		return err
+	}
+
+	if locked && user != nil {
+		app.background(func() {
+			data := map[string]any{
+				"name": user.Name,
+				"ip":   ip,
+			}
+
+			err := app.mailer.Send(user.Email, "user_locked.html", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	return nil
+}
+
+// resetLoginFailures() clears the failure count for an email address after a successful login.
+// The client IP's count is left alone, since many users may share one IP address.
+func (app *application) resetLoginFailures(email string) error {
+	return app.models.LoginFailures.Reset(data.LoginFailureKeyEmail(email))
+}
+
+// invalidLoginResponse() records a failed login attempt and sends a 401 Unauthorized response.
+func (app *application) invalidLoginResponse(w http.ResponseWriter, r *http.Request, user *data.User, email, ip string) {
+	err := app.recordLoginFailure(user, email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidCredentialsResponse(w, r)
+}
+
+// confirmPassword() checks the password of an authenticated user who has been asked to enter it
+// again to confirm a sensitive change. This is subject to the same lockout as logging in, so that
+// someone holding a stolen session can't use it to guess the password. If the account is locked or
+// the password is wrong, it sends an error response and returns false. A correct password doesn't
+// reset the failure count, so it can't be used to clear failed attempts at a second factor.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	ip := realip.FromRequest(r)
+
+	lockedUntil, err := app.loginLockedUntil(user.Email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, lockedUntil)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		app.invalidLoginResponse(w, r, user, user.Email, ip)
+		return false
+	}
+
+	return true
+}
+
+// confirmTOTP() checks a TOTP code or recovery code which an authenticated user has entered to
+// confirm a change to their two-factor settings. Like confirmPassword(), it refuses while the
+// account is locked and counts wrong codes as failed logins, so that a session can't be used to
+// brute force the 6-digit code.
+func (app *application) confirmTOTP(w http.ResponseWriter, r *http.Request, user *data.User, code, recoveryCode string) bool {
+	ip := realip.FromRequest(r)
+
+	lockedUntil, err := app.loginLockedUntil(user.Email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, lockedUntil)
+		return false
+	}
+
+	ok, err := app.verifyTOTP(user.ID, code, recoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.invalidLoginResponse(w, r, user, user.Email, ip)
+		return false
+	}
+
+	return true
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/jwt"
 	"github.com/arynkh/greenlight/internal/mailer"
+	"github.com/arynkh/greenlight/internal/oidc"
 
 	_ "github.com/lib/pq"
 )
@@ -19,9 +23,10 @@ const version = "1.0.0" //app version number
 
 // holds all config settings for the app.
 type config struct {
-	port int
-	env  string //(dev, staging, prod, etc)
-	db   struct {
+	port           int
+	env            string //(dev, staging, prod, etc)
+	requireIfMatch bool   //whether changes to movies must include an If-Match header
+	db             struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
@@ -39,15 +44,53 @@ type config struct {
 		password string
 		sender   string
 	}
+	auth struct {
+		mode       string //(stateful|jwt)
+		refreshTTL time.Duration
+	}
+	lockout struct {
+		emailThreshold int
+		ipThreshold    int
+		baseDuration   time.Duration
+		maxDuration    time.Duration
+	}
+	deletion struct {
+		gracePeriod time.Duration
+	}
+	argon2 struct {
+		memory      uint
+		iterations  uint
+		parallelism uint
+	}
+	cursor struct {
+		secret string
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+	}
+	jwt struct {
+		algorithm string
+		keys      string
+		issuer    string
+		audience  string
+		ttl       time.Duration
+	}
 }
 
 // holds dependencies for our HTTP handlers, helpers & middleware
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer *mailer.Mailer
-	wg     sync.WaitGroup
+	config      config
+	logger      *slog.Logger
+	models      data.Models
+	mailer      *mailer.Mailer
+	jwtKeys     jwt.KeySet
+	oidc        *oidc.Provider
+	cursorKey   []byte
+	suggestions *ttlCache[[]*data.MovieSuggestion]
+	wg          sync.WaitGroup
 }
 
 func main() {
@@ -75,10 +118,84 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "395abe4d24d984", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <noreply@greenlight.arynhead.net>", "SMTP sender")
 
+	//Read the authentication settings. In "jwt" mode the authentication endpoint issues signed JWTs
+	//which can be verified without a database lookup, instead of stateful tokens.
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "stateful", "Authentication token mode (stateful|jwt)")
+	flag.DurationVar(&cfg.auth.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	flag.StringVar(&cfg.jwt.algorithm, "jwt-algorithm", jwt.HS256, "JWT signing algorithm (HS256|EdDSA)")
+	flag.StringVar(&cfg.jwt.keys, "jwt-keys", os.Getenv("GREENLIGHT_JWT_KEYS"), "Comma-separated JWT keys in kid:key format, the first key is used for signing")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "greenlight.arynhead.net", "JWT issuer")
+	flag.StringVar(&cfg.jwt.audience, "jwt-audience", "greenlight.arynhead.net", "JWT audience")
+	flag.DurationVar(&cfg.jwt.ttl, "jwt-ttl", 15*time.Minute, "JWT lifetime")
+
+	flag.DurationVar(&cfg.deletion.gracePeriod, "deletion-grace-period", 30*24*time.Hour, "Time before a deleted account is anonymised")
+
+	//Read the argon2id password hashing parameters. Changing these only affects new hashes; existing
+	//hashes are upgraded automatically when their owner next logs in
+	flag.UintVar(&cfg.argon2.memory, "argon2-memory", 64*1024, "Argon2id memory cost in KiB")
+	flag.UintVar(&cfg.argon2.iterations, "argon2-iterations", 3, "Argon2id number of iterations")
+	flag.UintVar(&cfg.argon2.parallelism, "argon2-parallelism", 2, "Argon2id degree of parallelism")
+
+	//Read the login brute-force protection settings. Failed logins are counted both per email address
+	//and per client IP, and lead to lockouts which double in length with every further failure
+	flag.IntVar(&cfg.lockout.emailThreshold, "lockout-email-threshold", 5, "Failed logins per email address before the account is locked")
+	flag.IntVar(&cfg.lockout.ipThreshold, "lockout-ip-threshold", 20, "Failed logins per client IP before the IP is locked out")
+	flag.DurationVar(&cfg.lockout.baseDuration, "lockout-base-duration", time.Minute, "Initial lockout duration")
+	flag.DurationVar(&cfg.lockout.maxDuration, "lockout-max-duration", 24*time.Hour, "Maximum lockout duration")
+
+	//Clients can send the ETag of a movie in an If-Match header to avoid overwriting changes made
+	//by someone else in the meantime. This makes it mandatory
+	flag.BoolVar(&cfg.requireIfMatch, "require-if-match", false, "Require an If-Match header when updating or deleting movies")
+
+	//Read the secret used to sign pagination cursors. All instances of the API behind a load balancer
+	//must share the same secret, otherwise cursors issued by one instance are rejected by the others
+	flag.StringVar(&cfg.cursor.secret, "cursor-secret", os.Getenv("GREENLIGHT_CURSOR_SECRET"), "Secret key for signing pagination cursors (random if empty)")
+
+	//Read the OpenID Connect settings. Single sign-on is only enabled if an issuer is provided
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL (leave empty to disable single sign-on)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", os.Getenv("GREENLIGHT_OIDC_CLIENT_SECRET"), "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL, pointing at /v1/oidc/callback")
+
 	flag.Parse()
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	if cfg.argon2.parallelism < 1 || cfg.argon2.parallelism > 255 || cfg.argon2.iterations < 1 || cfg.argon2.memory < 8*cfg.argon2.parallelism {
+		logger.Error("invalid argon2id parameters")
+		os.Exit(1)
+	}
+
+	data.PasswordParams.Memory = uint32(cfg.argon2.memory)
+	data.PasswordParams.Iterations = uint32(cfg.argon2.iterations)
+	data.PasswordParams.Parallelism = uint8(cfg.argon2.parallelism)
+
+	//Load the JWT keys up front so that a misconfiguration is caught at startup rather than on
+	//the first login
+	var jwtKeys jwt.KeySet
+
+	switch cfg.auth.mode {
+	case "stateful":
+		//Stateful tokens are stored in the database, so there are no keys to load
+	case "jwt":
+		var err error
+		jwtKeys, err = parseJWTKeys(cfg.jwt.algorithm, cfg.jwt.keys)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	default:
+		logger.Error(fmt.Sprintf("invalid auth mode %q", cfg.auth.mode))
+		os.Exit(1)
+	}
+
+	//Without a configured secret, use a random one. Cursors then stop working when the server restarts
+	cursorKey := []byte(cfg.cursor.secret)
+	if len(cursorKey) == 0 {
+		cursorKey = make([]byte, 32)
+		rand.Read(cursorKey)
+	}
+
 	//call the openDB() helper function to create the connection pool, passing in the config struct as an argument.
 	db, err := openDB(cfg)
 	if err != nil {
@@ -97,11 +214,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	//The identity provider's discovery document and keys are fetched lazily, on the first sign-in
+	var provider *oidc.Provider
+	if cfg.oidc.issuer != "" {
+		provider = oidc.New(cfg.oidc.issuer, cfg.oidc.clientID, cfg.oidc.clientSecret, cfg.oidc.redirectURL)
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer,
+		config:    cfg,
+		logger:    logger,
+		models:    data.NewModels(db),
+		mailer:    mailer,
+		jwtKeys:   jwtKeys,
+		oidc:      provider,
+		cursorKey: cursorKey,
+		//Title suggestions for popular prefixes are requested over and over as users type, so
+		//keep them around for a short while
+		suggestions: newTTLCache[[]*data.MovieSuggestion](30*time.Second, 10_000),
 	}
 
 	err = app.serve()
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/validator"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 )
@@ -91,3 +95,223 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//Add the "Vary: Authorization" and "Vary: X-API-Key" headers to the response. This indicates
+		//to any caches that the response may vary based on the credentials in the request
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+
+		//Retrieve the value of the Authorization and X-API-Key headers from the request. These will
+		//return the empty string "" if there is no such header found
+		authorizationHeader := r.Header.Get("Authorization")
+		apiKeyHeader := r.Header.Get("X-API-Key")
+
+		//If there are no credentials, add the AnonymousUser to the request context, then call the
+		//next handler in the chain and return without executing any of the code below
+		if authorizationHeader == "" && apiKeyHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//Sending both an API key and an authorization header is ambiguous: rather than guess which
+		//one the client meant to use, reject the request
+		if authorizationHeader != "" && apiKeyHeader != "" {
+			app.ambiguousCredentialsResponse(w, r)
+			return
+		}
+
+		//Machine clients can send an API key in the X-API-Key header
+		if apiKeyHeader != "" {
+			app.authenticateAPIKey(w, r, next, apiKeyHeader)
+			return
+		}
+
+		//Otherwise, we expect the value of the Authorization header to be in the format
+		//"Bearer <token>" or "ApiKey <key>". We try to split this into its constituent parts, and
+		//if the header isn't in the expected format we return a 401 Unauthorized response
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		//Extract the actual authentication token from the header parts
+		token := headerParts[1]
+
+		var (
+			user *data.User
+			err  error
+		)
+
+		switch app.config.auth.mode {
+		case "jwt":
+			//Verify the JWT and load the user it was issued to
+			user, err = app.userForJWT(token)
+		default:
+			//Validate the token to make sure it is in a sensible format
+			v := validator.New()
+
+			if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			//Retrieve the details of the user associated with the authentication token. Revoked
+			//tokens have been deleted from the database, so they are rejected here immediately
+			user, err = app.models.Users.GetForToken(data.ScopeAuthentication, token)
+			if err == nil {
+				err = app.models.Tokens.Touch(token)
+			}
+		}
+
+		//If no matching record was found, call invalidAuthenticationTokenResponse() to send a
+		//401 Unauthorized response
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		//Call the contextSetUser() helper to add the user information to the request context, along
+		//with the token itself
+		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateAPIKey() looks up the user that owns an API key, and adds both the user and the key
+// to the request context before calling the next handler.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, keyPlaintext string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, err := app.models.APIKeys.GetForKey(keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// The requireAuthenticatedUser() middleware checks that a user is not anonymous.
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireActivatedUser() middleware checks that a user is both authenticated and activated.
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	//Rather than returning this http.HandlerFunc we assign it to the variable fn
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		//Check that a user is activated
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	//Wrap fn with the requireAuthenticatedUser() middleware before returning it
+	return app.requireAuthenticatedUser(fn)
+}
+
+// The requireAuthenticationToken() middleware checks that a user is authenticated with an
+// authentication token rather than an API key. Account management (sessions, API keys, two-factor
+// settings and so on) is only open to the user themselves, so a leaked API key can't be used to
+// take over the account or to hide its own tracks.
+func (app *application) requireAuthenticationToken(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// Note that the first parameter for the middleware function is the permission code that
+// we require the user to have.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		//Retrieve the user from the request context
+		user := app.contextGetUser(r)
+
+		//Get the slice of permissions for the user
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		//Check if the slice includes the required permission. If it doesn't, then return a
+		//403 Forbidden response
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		//Requests authenticated with an API key are limited to the permissions granted to the key
+		if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		//Otherwise they have the required permission so we call the next handler in the chain
+		next.ServeHTTP(w, r)
+	}
+
+	//Wrap this with the requireActivatedUser() middleware before returning it
+	return app.requireActivatedUser(fn)
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/jsonpatch"
 	"github.com/arynkh/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
@@ -44,9 +53,12 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.suggestions.Clear()
+
 	//lets the client know where the newly created resource can be found. Make an empty http.Header map & use the Set() method to add a new "Location" header
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", movieETag(movie))
 
 	err = app.writeJSON(w, http.StatusCreated, envelop{"movie": movie}, headers)
 	if err != nil {
@@ -55,14 +67,37 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
+	//httprouter doesn't allow a fixed path segment alongside the :id parameter, so requests for
+	//GET /v1/movies/suggest are matched by this route and passed on from here
+	if httprouter.ParamsFromContext(r.Context()).ByName("id") == "suggest" {
+		app.suggestMoviesHandler(w, r)
+		return
+	}
+
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
+	//Clients which only need some of the fields can ask for just those with the fields parameter,
+	//and can have related resources embedded in the movie with the expand parameter
+	qs := r.URL.Query()
+	fields := app.readCSV(qs, "fields", []string{})
+	expand := app.readCSV(qs, "expand", []string{})
+
+	v := validator.New()
+
+	data.ValidateFields(v, "fields", fields, data.MovieFields)
+	data.ValidateFields(v, "expand", expand, data.MovieExpansions)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	//call the Get() method to retrieve the data for a specific movie.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(id, fields...)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -74,7 +109,41 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelop{"movie": movie}, nil)
+	err = app.models.Movies.Expand([]*data.Movie{movie}, expand)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{"movie": movie}
+
+	if len(fields) > 0 {
+		env["movie"] = movie.Select(slices.Concat(fields, expand))
+	}
+
+	headers := make(http.Header)
+	headers.Set("Accept-Patch", "application/json, application/merge-patch+json, application/json-patch+json")
+
+	//Expanded resources can change without the movie's version changing, and each sparse fieldset
+	//is a different representation of the movie which needs an ETag of its own, so in those cases
+	//the ETag is worked out from the response itself instead
+	if len(fields) > 0 || len(expand) > 0 {
+		err = app.writeJSONWithETag(w, r, http.StatusOK, env, headers)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	etag := movieETag(movie)
+
+	if app.notModified(w, r, etag) {
+		return
+	}
+
+	headers.Set("ETag", etag)
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -98,38 +167,40 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	//declare an input struct to hold the expected data from the client
-	//use pointers so that we can differentiate between a missing field & a field with a zero value
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
-
-	//read the JSON request body data into the input struct
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
+	//If the client sent the ETag of the movie it fetched, make sure that it hasn't been changed since
+	ok, conditional := app.checkIfMatch(w, r, movieETag(movie))
+	if !ok {
 		return
 	}
 
-	//if the input.Title value is nil, we know that no corresponding "title" key-value pair was provided. Resulting in leaving the movie
-	//record unchanged. Otherwise, update the movie record with the new title value.
-	if input.Title != nil {
-		movie.Title = *input.Title
-	}
-
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
-
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
-	}
+	//The request body can be a JSON Merge Patch or a JSON Patch, as well as the plain JSON object
+	//of fields to change. Any other content type is treated as plain JSON, as it always has been,
+	//so that clients which don't set the Content-Type header carry on working
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/merge-patch+json", "application/json-patch+json":
+		err = app.patchMovie(w, r, movie, mediaType)
+		if err != nil {
+			var readErr readError
+
+			switch {
+			case errors.As(err, &readErr):
+				app.badRequestResponse(w, r, err)
+			case errors.Is(err, jsonpatch.ErrTestFailed):
+				app.errorResponse(w, r, http.StatusConflict, err.Error())
+			default:
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+			}
+			return
+		}
 
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+	default:
+		err = app.readMovieUpdate(w, r, movie)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
 	}
 
 	v := validator.New()
@@ -142,6 +213,8 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	err = app.models.Movies.Update(movie)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -150,12 +223,114 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelop{"movie": movie}, nil)
+	app.suggestions.Clear()
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// readMovieUpdate() reads a plain JSON object of the fields to change from the request body and
+// applies it to the movie. Fields which aren't present are left unchanged.
+func (app *application) readMovieUpdate(w http.ResponseWriter, r *http.Request, movie *data.Movie) error {
+	//data.MovieChanges uses pointers so that we can differentiate between a missing field & a
+	//field with a zero value
+	var input data.MovieChanges
+
+	//read the JSON request body data into the input struct
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return err
+	}
+
+	//Fields which weren't provided are left unchanged
+	input.Apply(movie)
+
+	return nil
+}
+
+// moviePatchDocument is the JSON document which patches are applied to: the editable fields of a
+// movie. Clients can't patch the id or version.
+type moviePatchDocument struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+}
+
+// readError wraps errors from reading the request body, so that they can be told apart from
+// errors applying a patch.
+type readError struct{ error }
+
+func (e readError) Unwrap() error { return e.error }
+
+// patchMovie() reads a JSON Merge Patch (RFC 7396) or JSON Patch (RFC 6902) from the request body
+// and applies it to the movie. Unlike a plain JSON update, a merge patch can remove a field by
+// setting it to null, and a JSON patch can make changes inside the genres array, such as adding
+// a single genre with {"op": "add", "path": "/genres/-", "value": "Drama"}.
+func (app *application) patchMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie, mediaType string) error {
+	doc, err := json.Marshal(moviePatchDocument{
+		Title:   movie.Title,
+		Year:    movie.Year,
+		Runtime: movie.Runtime,
+		Genres:  movie.Genres,
+	})
+	if err != nil {
+		return err
+	}
+
+	var patched []byte
+
+	switch mediaType {
+	case "application/merge-patch+json":
+		var patch json.RawMessage
+
+		err = app.readJSON(w, r, &patch)
+		if err != nil {
+			return readError{err}
+		}
+
+		patched, err = jsonpatch.MergePatch(doc, patch)
+
+	case "application/json-patch+json":
+		var patch jsonpatch.Patch
+
+		err = app.readJSON(w, r, &patch)
+		if err != nil {
+			return readError{err}
+		}
+
+		patched, err = patch.Apply(doc)
+	}
+	if err != nil {
+		return err
+	}
+
+	//Decode the patched document strictly, so that patches which add unknown fields or values of
+	//the wrong type are rejected. Fields which were removed end up with zero values, which are
+	//then caught by ValidateMovie()
+	var result moviePatchDocument
+
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(&result)
+	if err != nil {
+		return fmt.Errorf("patched movie is invalid: %w", err)
+	}
+
+	movie.Title = result.Title
+	movie.Year = result.Year
+	movie.Runtime = result.Runtime
+	movie.Genres = result.Genres
+
+	return nil
+}
+
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -163,17 +338,45 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	//Conditional deletes need the current version of the movie to compare against the If-Match
+	//header, and then only delete the movie if it is still at that version
+	if r.Header.Get("If-Match") != "" || app.config.requireIfMatch {
+		var movie *data.Movie
+
+		movie, err = app.models.Movies.Get(id, "version")
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if ok, _ := app.checkIfMatch(w, r, movieETag(movie)); !ok {
+			return
+		}
+
+		err = app.models.Movies.DeleteVersion(movie.ID, movie.Version)
+	} else {
+		err = app.models.Movies.Delete(id)
+	}
+
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	app.suggestions.Clear()
+
 	err = app.writeJSON(w, http.StatusOK, envelop{"message": "movie successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -182,9 +385,11 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieFilters
 		data.Filters
+		Facets []string
+		Fields []string
+		Expand []string
 	}
 
 	v := validator.New()
@@ -193,26 +398,272 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	qs := r.URL.Query()
 
 	input.Title = app.readString(qs, "title", "")
+	input.Search = app.readString(qs, "q", "")
+	input.SearchMode = app.readString(qs, "search_mode", "fulltext")
+	input.Language = app.readString(qs, "lang", "simple")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.GenresAny = app.readCSV(qs, "genres_any", []string{})
+	input.ExcludeGenres = app.readCSV(qs, "exclude_genres", []string{})
+
+	input.YearMin = app.readInt(qs, "year_min", 0, v)
+	input.YearMax = app.readInt(qs, "year_max", 0, v)
+	input.RuntimeMin = app.readInt(qs, "runtime_min", 0, v)
+	input.RuntimeMax = app.readInt(qs, "runtime_max", 0, v)
+
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	input.Facets = app.readCSV(qs, "facets", []string{})
+
+	input.Fields = app.readCSV(qs, "fields", []string{})
+	input.Expand = app.readCSV(qs, "expand", []string{})
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.Sort, input.Filters.SortSafelist = app.readMovieSort(qs, input.Title != "" || input.Search != "")
+
+	//The cursor from the metadata of a previous response can be used instead of the page number
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.CursorKey = app.cursorKey
+
+	data.ValidateMovieFilters(v, input.MovieFilters)
+
+	for _, facet := range input.Facets {
+		v.Check(validator.PermittedValue(facet, data.MovieFacets...), "facets", "must only contain "+strings.Join(data.MovieFacets, ", "))
+	}
+	v.Check(validator.Unique(input.Facets), "facets", "must not contain duplicate values")
+
+	data.ValidateFields(v, "fields", input.Fields, data.MovieListFields)
+	data.ValidateFields(v, "expand", input.Expand, data.MovieExpansions)
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	//The facets count all of the movies matching the filters, not just the ones on this page. They
+	//are read from the same snapshot as the page itself, so that the two agree
+	var (
+		movies   []*data.Movie
+		metadata data.Metadata
+		facets   map[string][]data.FacetCount
+		err      error
+	)
+
+	if len(input.Facets) > 0 {
+		movies, metadata, facets, err = app.models.Movies.GetAllWithFacets(input.MovieFilters, input.Filters, input.Facets, input.Fields...)
+	} else {
+		movies, metadata, err = app.models.Movies.GetAll(input.MovieFilters, input.Filters, input.Fields...)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Movies.Expand(movies, input.Expand)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{"movies": movies, "metadata": metadata}
+
+	if len(input.Fields) > 0 {
+		selected := make([]map[string]any, len(movies))
+		for i, movie := range movies {
+			selected[i] = movie.Select(slices.Concat(input.Fields, input.Expand))
+		}
+		env["movies"] = selected
+	}
+
+	if facets != nil {
+		env["facets"] = facets
+	}
+
+	err = app.writeJSONWithETag(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readMovieSort() reads the sort parameter for the movie listing, and returns it along with the
+// values it's allowed to take. Sorting by relevance only makes sense when searching, and always
+// puts the best matches first; it's also the default for searches, as the best matches are what
+// the client is most likely to be after.
+func (app *application) readMovieSort(qs url.Values, searching bool) (string, []string) {
+	safelist := []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+	if !searching {
+		return app.readString(qs, "sort", "id"), safelist
+	}
+
+	sort := app.readString(qs, "sort", "-relevance")
+	if sort == "relevance" {
+		sort = "-relevance"
+	}
+
+	return sort, append(safelist, "-relevance")
+}
+
+// suggestMoviesHandler() returns movies whose title starts with the q parameter, for
+// autocompletion as the user types.
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	//Normalise the prefix so that the cache is shared by differently capitalised requests
+	prefix := strings.ToLower(strings.TrimSpace(app.readString(qs, "q", "")))
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(prefix != "", "q", "must be provided")
+	v.Check(len(prefix) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key := fmt.Sprintf("%d:%s", limit, prefix)
+
+	suggestions, ok := app.suggestions.Get(key)
+	if !ok {
+		var err error
+
+		suggestions, err = app.models.Movies.Suggest(prefix, limit)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.suggestions.Set(key, suggestions)
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelop{"suggestions": suggestions}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// batchMoviesHandler() creates, updates and deletes many movies in one request. In atomic mode
+// (the default) either all of the operations succeed or none of them are applied. In best_effort
+// mode each operation succeeds or fails independently.
+func (app *application) batchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode       string `json:"mode"`
+		Operations []struct {
+			Op      string            `json:"op"`
+			ID      int64             `json:"id"`
+			Version int32             `json:"version"`
+			Movie   data.MovieChanges `json:"movie"`
+		} `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelop{"movies": movies, "metadata": metadata}, nil)
+	if input.Mode == "" {
+		input.Mode = "atomic"
+	}
+
+	v := validator.New()
+
+	v.Check(validator.PermittedValue(input.Mode, "atomic", "best_effort"), "mode", "must be atomic or best_effort")
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least 1 operation")
+	v.Check(len(input.Operations) <= 1000, "operations", "must not contain more than 1000 operations")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	atomic := input.Mode == "atomic"
+
+	//Validate each operation on its own, keeping the errors keyed by the operation's index.
+	//Updates can only be fully validated once the current movie has been read, which happens in
+	//the model
+	var ops []data.BatchOperation
+	errs := make(map[string]map[string]string)
+
+	for i, operation := range input.Operations {
+		v := validator.New()
+
+		v.Check(validator.PermittedValue(operation.Op, "create", "update", "delete"), "op", "must be create, update or delete")
+
+		switch operation.Op {
+		case "create":
+			v.Check(operation.ID == 0, "id", "must not be provided")
+			v.Check(operation.Version == 0, "version", "must not be provided")
+
+			movie := &data.Movie{}
+			operation.Movie.Apply(movie)
+			data.ValidateMovie(v, movie)
+		case "update", "delete":
+			v.Check(operation.ID > 0, "id", "must be provided")
+
+			//Operations in a batch can't each send an If-Match header, so when one is required for
+			//single changes, the version stands in for it
+			if app.config.requireIfMatch {
+				v.Check(operation.Version > 0, "version", "must be provided")
+			}
+		}
+
+		if !v.Valid() {
+			errs[strconv.Itoa(i)] = v.Errors
+			continue
+		}
+
+		ops = append(ops, data.BatchOperation{
+			Index:   i,
+			Op:      operation.Op,
+			ID:      operation.ID,
+			Version: operation.Version,
+			Changes: operation.Movie,
+		})
+	}
+
+	//In atomic mode nothing is applied if any operation is invalid
+	if atomic && len(errs) > 0 {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	results, err := app.models.Movies.Batch(ops, atomic)
+	if err != nil && !errors.Is(err, data.ErrBatchRolledBack) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.suggestions.Clear()
+
+	//In best-effort mode database errors are reported per operation, but we still want them logged
+	for _, result := range results {
+		if result.Err != nil {
+			app.logError(r, result.Err)
+		}
+	}
+
+	//Put the results back in the order of the request, including the invalid operations
+	all := make([]data.BatchResult, len(input.Operations))
+	for i := range all {
+		all[i] = data.BatchResult{Index: i, Status: "failed", Error: errs[strconv.Itoa(i)]}
+	}
+	for _, result := range results {
+		all[result.Index] = result
+	}
+
+	status := http.StatusOK
+	if errors.Is(err, data.ErrBatchRolledBack) {
+		status = http.StatusUnprocessableEntity
+	}
+
+	err = app.writeJSON(w, status, envelop{"results": all}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
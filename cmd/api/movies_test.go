@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestReadMovieSort(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		searching bool
+		want      string
+	}{
+		{name: "default", query: "", want: "id"},
+		{name: "explicit", query: "sort=-year", want: "-year"},
+		{name: "search default", query: "title=alien", searching: true, want: "-relevance"},
+		{name: "search explicit", query: "q=alien&sort=title", searching: true, want: "title"},
+		{name: "search by relevance", query: "q=alien&sort=relevance", searching: true, want: "-relevance"},
+	}
+
+	app := &application{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sort, safelist := app.readMovieSort(qs, tt.searching)
+			if sort != tt.want {
+				t.Errorf("sort = %q, want %q", sort, tt.want)
+			}
+
+			//Relevance can only be sorted by when searching
+			if slices.Contains(safelist, "-relevance") != tt.searching {
+				t.Errorf("safelist = %v, searching = %v", safelist, tt.searching)
+			}
+		})
+	}
+}
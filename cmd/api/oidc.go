@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/oidc"
+)
+
+// Start signing in with the identity provider. The client is redirected to the provider's
+// authorization endpoint, which will send them back to /v1/oidc/callback.
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	state := oidc.GenerateVerifier()
+	oidcState := data.OIDCState{
+		Nonce:        oidc.GenerateVerifier(),
+		CodeVerifier: oidc.GenerateVerifier(),
+	}
+
+	err := app.models.Identities.InsertState(state, oidcState, 10*time.Minute)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := app.oidc.AuthCodeURL(r.Context(), state, oidcState.Nonce, oidcState.CodeVerifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Complete signing in with the identity provider. The authorization code is exchanged for an ID
+// token, which identifies the user, and we respond with authentication tokens as for a normal login.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	//The provider reports errors (such as the user refusing consent) in the query string
+	if providerError := app.readString(qs, "error", ""); providerError != "" {
+		app.badRequestResponse(w, r, errors.New("identity provider returned an error: "+providerError))
+		return
+	}
+
+	code := app.readString(qs, "code", "")
+	state := app.readString(qs, "state", "")
+
+	if code == "" || state == "" {
+		app.badRequestResponse(w, r, errors.New("code and state parameters must be provided"))
+		return
+	}
+
+	oidcState, err := app.models.Identities.ConsumeState(state)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.badRequestResponse(w, r, errors.New("invalid or expired state parameter"))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), code, oidcState.CodeVerifier, oidcState.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken), errors.Is(err, oidc.ErrInvalidNonce):
+			app.logger.Warn("rejected ID token", "error", err.Error())
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.userForIdentity(claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			app.errorResponse(w, r, http.StatusForbidden, "your identity provider account must have a verified email address")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Signing in through the provider replaces the password, but not the second factor
+	if app.sendTOTPChallenge(w, r, user) {
+		return
+	}
+
+	app.issueAuthenticationTokens(w, r, user)
+}
+
+var errUnverifiedEmail = errors.New("unverified email address")
+
+// userForIdentity() returns the user linked to the external identity in the ID token claims. If
+// there isn't one yet, the identity is linked to the existing user with the same (verified) email
+// address, or a new activated user is created for it.
+func (app *application) userForIdentity(claims *oidc.IDTokenClaims) (*data.User, error) {
+	user, err := app.models.Identities.GetUser(claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	//We're about to trust the provider's claim about the email address, so it must be verified
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errUnverifiedEmail
+	}
+
+	user, err = app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		//The provider has verified that the user owns the address, which is all that activation
+		//proves. But an unactivated account may have been registered by someone else, who chose
+		//the password, in the hope that the real owner of the address would later take it over
+		if !user.Activated {
+			err = app.claimUnactivatedUser(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case errors.Is(err, data.ErrRecordNotFound):
+		name := claims.Name
+		if name == "" {
+			name = claims.Email
+		}
+
+		user = &data.User{
+			Name:      name,
+			Email:     claims.Email,
+			Activated: true,
+		}
+
+		//The user signs in through the provider, so give them a random password that nobody
+		//knows. They can still set one with the password reset flow
+		err = user.Password.Set(rand.Text())
+		if err != nil {
+			return nil, err
+		}
+
+		err = app.models.Users.Insert(user)
+		if err != nil {
+			return nil, err
+		}
+
+		err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, err
+	}
+
+	err = app.models.Identities.Link(claims.Issuer, claims.Subject, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// claimUnactivatedUser() activates an account on behalf of the verified owner of its email address.
+// Whoever registered the account never proved that they own the address, so everything they could
+// have set up is thrown away: the password is replaced with a random one, and all of the account's
+// tokens, refresh tokens and API keys are revoked, along with any TOTP enrollment and pending
+// email change.
+func (app *application) claimUnactivatedUser(user *data.User) error {
+	err := user.Password.Set(rand.Text())
+	if err != nil {
+		return err
+	}
+
+	user.Activated = true
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Tokens.RevokeAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.RefreshTokens.DeleteAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Users.RevokeJWTs(user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.APIKeys.DeleteAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return app.models.EmailChanges.Delete(user.ID)
+}
@@ -16,14 +16,58 @@ func (app *application) routes() http.Handler {
 
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMoviesHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthCheckHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
+
+	//Use the requirePermission() middleware on each of the /v1/movies** endpoints, passing in
+	//the required permission code as the first parameter
+	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/batch", app.requirePermission("movies:write", app.batchMoviesHandler))
+	//This also serves GET /v1/movies/suggest, see showMovieHandler()
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	//Managing the account itself requires an authentication token; API keys are turned away
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireActivatedUser(app.requireAuthenticationToken(app.updateCurrentUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticationToken(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireAuthenticationToken(app.exportUserDataHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireActivatedUser(app.requireAuthenticationToken(app.requestEmailChangeHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticationToken(app.listUserSessionsHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.requireAuthenticationToken(app.enrollTOTPHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp/confirm", app.requireActivatedUser(app.requireAuthenticationToken(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.requireAuthenticationToken(app.disableTOTPHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireAuthenticationToken(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireAuthenticationToken(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.requireAuthenticationToken(app.deleteAPIKeyHandler)))
+
+	//The admin API requires the users:admin permission throughout
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/activated", app.requirePermission("users:admin", app.updateUserActivatedHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission("users:admin", app.forceUserPasswordResetHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("users:admin", app.unlockUserHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/totp", app.createTOTPAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/all", app.requireAuthenticationToken(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	//Only register the single sign-on routes if an identity provider has been configured
+	if app.oidc != nil {
+		router.HandlerFunc(http.MethodGet, "/v1/oidc/login", app.oidcLoginHandler)
+		router.HandlerFunc(http.MethodGet, "/v1/oidc/callback", app.oidcCallbackHandler)
+	}
 
-	return app.recoverPanic(app.rateLimit(router))
+	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
 }
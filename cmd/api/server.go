@@ -28,6 +28,10 @@ func (app *application) serve() error {
 	//Create a shutdownError channel. Use this to receive any errors returned by the graceful Shutdown() function
 	shutdownError := make(chan error)
 
+	//Create a done channel, which is closed when we start shutting down to tell long-running
+	//background routines to stop
+	done := make(chan struct{})
+
 	//Start a background routine
 	go func() {
 		//Create a quit (buffered) channel which carries os.Signal values
@@ -42,6 +46,8 @@ func (app *application) serve() error {
 
 		app.logger.Info("shutting down server", "signal", s.String())
 
+		close(done)
+
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
@@ -61,6 +67,13 @@ func (app *application) serve() error {
 		shutdownError <- nil
 	}()
 
+	//Start a background routine which carries out scheduled account deletions once their grace
+	//period is over. It is tracked by the WaitGroup like any other background task, and stops
+	//when the done channel is closed on shutdown
+	app.background(func() {
+		app.processAccountDeletions(done)
+	})
+
 	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
 
 	err := srv.ListenAndServe()
@@ -80,3 +93,26 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// processAccountDeletions() anonymises the accounts whose deletion grace period is over, once at
+// startup and then every hour, until the done channel is closed.
+func (app *application) processAccountDeletions(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n, err := app.models.UserDeletions.ProcessDue()
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+		if n > 0 {
+			app.logger.Info("anonymised deleted user accounts", "count", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//Parse the email and password from the request body
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//Validate the email and password provided by the client
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Refuse to even check the password if there have been too many failed attempts for this
+	//email address or from this IP address recently
+	ip := realip.FromRequest(r)
+
+	lockedUntil, err := app.loginLockedUntil(input.Email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, lockedUntil)
+		return
+	}
+
+	//Lookup the user record based on the email address. If no matching user was found, then we
+	//record the failure and call the invalidCredentialsResponse() helper to send a 401 Unauthorized
+	//response to the client
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidLoginResponse(w, r, nil, input.Email, ip)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Check if the provided password matches the actual password for the user
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//If the passwords don't match, then we record the failure and send a 401 Unauthorized response
+	if !match {
+		app.invalidLoginResponse(w, r, user, input.Email, ip)
+		return
+	}
+
+	//Now that we know the plaintext password, take the chance to upgrade the stored hash if it
+	//was made with bcrypt or with outdated argon2id parameters. A failure here shouldn't stop the
+	//user from logging in, so we just log it
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(input.Password)
+		if err == nil {
+			err = app.models.Users.Update(user)
+		}
+		if err != nil {
+			app.logger.Error("unable to rehash password", "user_id", user.ID, "error", err.Error())
+		}
+	}
+
+	//If the user has two-factor authentication enabled, the password alone isn't enough
+	if app.sendTOTPChallenge(w, r, user) {
+		return
+	}
+
+	//Only reset the failure count once the user is fully authenticated. Resetting it after the
+	//password alone would let someone who knows the password keep guessing TOTP codes without
+	//ever being locked out; with TOTP enabled the reset happens once a valid code is provided
+	err = app.resetLoginFailures(input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Otherwise, if the password is correct, we issue new tokens for the user
+	app.issueAuthenticationTokens(w, r, user)
+}
+
+// sendTOTPChallenge() checks whether the user has two-factor authentication enabled. If they do,
+// it issues a short-lived challenge token, which the client exchanges along with a valid code at
+// POST /v1/tokens/authentication/totp, and sends it in a 202 Accepted response. It returns true
+// if a response has been sent, either with the challenge or with an error.
+func (app *application) sendTOTPChallenge(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	totp, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return true
+	}
+
+	if totp == nil || !totp.Confirmed {
+		return false
+	}
+
+	challenge, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTOTPChallenge)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return true
+	}
+
+	env := envelop{
+		"challenge_token": challenge,
+		"message":         "two-factor authentication code required",
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+	return true
+}
+
+// Exchange a two-factor challenge token and a valid TOTP (or recovery) code for authentication tokens.
+func (app *application) createTOTPAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.ChallengeToken)
+
+	//Exactly one of the code and the recovery code must be provided
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	} else {
+		v.Check(input.Code == "", "code", "must not be provided together with a recovery code")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTOTPChallenge, input.ChallengeToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("challenge_token", "invalid or expired challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Guessing codes counts towards the same lockout as guessing passwords
+	ip := realip.FromRequest(r)
+
+	lockedUntil, err := app.loginLockedUntil(user.Email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !lockedUntil.IsZero() {
+		app.loginLockedResponse(w, r, lockedUntil)
+		return
+	}
+
+	ok, err := app.verifyTOTP(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.invalidLoginResponse(w, r, user, user.Email, ip)
+		return
+	}
+
+	err = app.resetLoginFailures(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//The challenge has been passed, so make sure it can't be used again
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeTOTPChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationTokens(w, r, user)
+}
+
+// issueAuthenticationTokens() creates an access token and a new refresh token family for the
+// user, and sends them to the client in a 201 Created response.
+func (app *application) issueAuthenticationTokens(w http.ResponseWriter, r *http.Request, user *data.User) {
+	//Logging in during the grace period cancels a scheduled account deletion
+	cancelled, err := app.models.UserDeletions.Cancel(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if cancelled {
+		app.logger.Info("scheduled account deletion cancelled by login", "user_id", user.ID)
+	}
+
+	token, err := app.createAccessToken(user, realip.FromRequest(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Start a new refresh token family so that the client can renew the access token later
+	//without sending the password again
+	refreshToken, err := app.models.RefreshTokens.New(user.ID, app.config.auth.refreshTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Encode the tokens to JSON and send them in the response along with a 201 Created status code
+	env := envelop{"authentication_token": token, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a refresh token for a new access token, rotating the refresh token in the process.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Rotate the refresh token. If the token has been used before, the whole token family has now
+	//been revoked and we log the event, since it means the token has most likely been leaked
+	refreshToken, err := app.models.RefreshTokens.Rotate(input.TokenPlaintext, app.config.auth.refreshTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.logger.Warn("refresh token reuse detected, token family revoked", "ip", realip.FromRequest(r))
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(refreshToken.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Access tokens are only renewed for activated users, so that a deactivated user can't keep
+	//their session going with a refresh token
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+
+	token, err := app.createAccessToken(user, realip.FromRequest(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{"authentication_token": token, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Generate a password reset token and send it to the user's email address.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//Parse and validate the user's email address
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Try to retrieve the corresponding user record for the email address. If it can't be found,
+	//return an error message to the client
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Return an error message if the user is not activated
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Otherwise, create a new password reset token with a 45-minute expiry time
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Email the user with their password reset token
+	app.background(func() {
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		//Since email addresses MAY be case sensitive, notice that we are sending this email using
+		//the address stored in our database for the user --- not to the input.Email address
+		//provided by the client in this request
+		err := app.mailer.Send(user.Email, "token_password_reset.html", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	//Send a 202 Accepted response and confirmation message to the client
+	env := envelop{"message": "an email will be sent to you containing password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAccessToken() issues an authentication token for the user according to the configured
+// auth mode: either a signed JWT, or a stateful token with a 24-hour expiry time and the scope
+// 'authentication'.
+func (app *application) createAccessToken(user *data.User, clientIP string) (*data.Token, error) {
+	if app.config.auth.mode == "jwt" {
+		return app.createJWT(user)
+	}
+
+	return app.models.Tokens.NewForClient(user.ID, 24*time.Hour, data.ScopeAuthentication, clientIP)
+}
+
+// Revoke the token used to authenticate the current request.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//Requests authenticated with an API key have no authentication token to revoke. Rather than
+	//report a success that didn't happen, point the client at the endpoint for deleting keys
+	if app.contextGetAPIKey(r) != nil {
+		app.badRequestResponse(w, r, errors.New("API keys cannot be revoked here, use DELETE /v1/users/me/api-keys/:id instead"))
+		return
+	}
+
+	//We don't keep a record of individual JWTs, so there is nothing we can delete to revoke just
+	//one of them. They are short-lived instead, and DELETE /v1/tokens/all revokes all of them.
+	if app.config.auth.mode == "jwt" {
+		app.badRequestResponse(w, r, errors.New("JWT access tokens cannot be revoked individually, use DELETE /v1/tokens/all instead"))
+		return
+	}
+
+	err := app.models.Tokens.Delete(app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke every authentication and refresh token for the current user, signing them out everywhere.
+// In JWT mode this also rejects any access tokens which have already been issued.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.RefreshTokens.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.RevokeJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "all authentication tokens successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/data"
+	"github.com/arynkh/greenlight/internal/totp"
+	"github.com/arynkh/greenlight/internal/validator"
+)
+
+// verifyTOTP() checks either a TOTP code or a recovery code for the user. Accepted codes are
+// recorded so that neither kind of code can be used twice.
+func (app *application) verifyTOTP(userID int64, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+	}
+
+	settings, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	step, ok := totp.Validate(settings.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.TOTP.RecordStep(userID, step)
+}
+
+// Start two-factor enrollment. This generates a new secret and recovery codes, which are only
+// shown this once. Two-factor authentication isn't enabled until the enrollment is confirmed.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	//Ask for the password again, so that someone with a stolen token can't take over 2FA
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	existing, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if existing != nil && existing.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret := totp.GenerateSecret()
+	recoveryCodes := data.GenerateRecoveryCodes(10)
+
+	err = app.models.TOTP.Enroll(user.ID, secret, recoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{
+		"totp": map[string]any{
+			"secret":         secret,
+			"uri":            totp.URI("Greenlight", user.Email, secret),
+			"recovery_codes": recoveryCodes,
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Confirm two-factor enrollment with a code from the authenticator app, which proves that the
+// secret was imported correctly, and enable two-factor authentication.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	settings, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if settings.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.confirmTOTP(w, r, user, input.Code, "") {
+		return
+	}
+
+	err = app.models.TOTP.Confirm(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "two-factor authentication enabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Disable two-factor authentication. This requires both the password and a valid code (or
+// recovery code).
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	if !app.confirmTOTP(w, r, user, input.Code, input.RecoveryCode) {
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
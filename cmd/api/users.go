@@ -2,10 +2,14 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/arynkh/greenlight/internal/data"
 	"github.com/arynkh/greenlight/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -57,10 +61,31 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	//Add the "movies:read" permission for the new user
+	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//After the user record has been created in the database, generate a new activation token for the user
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	app.background(func() {
+		//There are now multiple pieces of data that we want to pass to our email templates, so we create
+		//a map to act as a 'holding structure' for the data
+		data := map[string]any{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+		}
+
 		//Call the Send() method on our Mailer, passing in the user's email address, name of the template
-		//file and the user struct contatining the new user's data
-		err := app.mailer.Send(user.Email, "user_welcome.html", user)
+		//file and the map containing the data for the templates
+		err := app.mailer.Send(user.Email, "user_welcome.html", data)
 		if err != nil {
 			app.logger.Error(err.Error())
 		}
@@ -72,3 +97,627 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	//Parse the plaintext activation token from the request body
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//Validate the plaintext token provided by the client
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Retrieve the details of the user associated with the token. If no matching record is found,
+	//then we let the client know that the token they provided is not valid
+	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Update the user's activation status
+	user.Activated = true
+
+	//Save the updated user record in our database, checking for any edit conflicts
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict), errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//If everything went successfully, then we delete all activation tokens for the user
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Send the updated user details to the client in a JSON response
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Verify the password reset token and set a new password for the user.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	//Parse and validate the user's new password and password reset token
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Retrieve the details of the user associated with the password reset token, returning an
+	//error message to the client if no matching record was found
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Set the new password for the user
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Save the updated user record in our database, checking for any edit conflicts as normal
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict), errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//If everything was successful, then revoke all outstanding tokens for the user so that any
+	//sessions using the old password are signed out too
+	err = app.models.Tokens.RevokeAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.RefreshTokens.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.RevokeJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Send the user a confirmation message
+	env := envelop{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the active sessions (authentication tokens) for the current user.
+func (app *application) listUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Update the current user's name and/or password. Changing the password requires the current password,
+// and signs the user out of every other session. The response then includes a new refresh token for
+// this session, and in JWT mode a new access token too.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	//Use pointers so that we can differentiate between a missing field & a field with a zero value
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		v.Check(input.CurrentPassword != "", "current_password", "must be provided to change the password")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		if !app.confirmPassword(w, r, user, input.CurrentPassword) {
+			return
+		}
+
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict), errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelop{"user": user}
+
+	//After a password change, sign the user out everywhere but here
+	if input.Password != nil {
+		err = app.models.Tokens.RevokeOtherForUser(user.ID, app.contextGetToken(r))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.RefreshTokens.DeleteAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Users.RevokeJWTs(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		//Refresh tokens aren't tied to a particular session, so this session has just lost its
+		//refresh token along with all the others; give it a new one. In JWT mode its access token
+		//has been revoked too, so it gets a new access token as well
+		if app.config.auth.mode == "jwt" {
+			token, err := app.createAccessToken(user, realip.FromRequest(r))
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			env["authentication_token"] = token
+		}
+
+		refreshToken, err := app.models.RefreshTokens.New(user.ID, app.config.auth.refreshTTL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["refresh_token"] = refreshToken
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Start changing the current user's email address. A confirmation token is sent to both the new
+// address and the current one, and nothing changes until the change has been confirmed from both.
+// Someone who has got hold of a session can't move the account to an address they control without
+// the owner noticing.
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different to your current email address")
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, input.CurrentPassword) {
+		return
+	}
+
+	//Check up front that the address isn't taken, so that the user finds out now rather than
+	//when they try to confirm. The unique constraint still protects us from races
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Replace any earlier pending change, so that only the most recent tokens are valid
+	for _, scope := range []string{data.ScopeEmailChange, data.ScopeEmailChangeCurrent} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.EmailChanges.Set(user.ID, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	newAddressToken, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	currentAddressToken, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChangeCurrent)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(input.Email, "email_change_confirm.html", map[string]any{
+			"name":             user.Name,
+			"emailChangeToken": newAddressToken.Plaintext,
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		err = app.mailer.Send(user.Email, "email_change_confirm_current.html", map[string]any{
+			"name":             user.Name,
+			"newEmail":         input.Email,
+			"emailChangeToken": currentAddressToken.Plaintext,
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelop{"message": "an email will be sent to both the new and the current address containing confirmation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Confirm a pending email address change with one of the tokens sent to the new and the current
+// address. The change is applied once both tokens have been used.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//The token may have been sent to either the new or the current address, so try both scopes
+	scope := data.ScopeEmailChange
+
+	user, err := app.models.Users.GetForToken(scope, input.TokenPlaintext)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		scope = data.ScopeEmailChangeCurrent
+		user, err = app.models.Users.GetForToken(scope, input.TokenPlaintext)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	email, confirmed, err := app.models.EmailChanges.Confirm(user.ID, scope)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Each token can only be used once
+	err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//If the other address hasn't confirmed the change yet, there is nothing more to do for now
+	if !confirmed {
+		env := envelop{"message": "confirmation received, the change will take effect once it has been confirmed from the other address too"}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Email = email
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict), errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.EmailChanges.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Export all the personal data we hold about the current user as a JSON archive.
+func (app *application) exportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refreshTokens, err := app.models.RefreshTokens.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	totp, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Leave the pending email change and scheduled deletion as nil (encoded as JSON null) if there
+	//aren't any
+	var pendingEmail, scheduledDeletion any
+
+	email, err := app.models.EmailChanges.Get(user.ID)
+	switch {
+	case err == nil:
+		pendingEmail = email
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	scheduledFor, err := app.models.UserDeletions.Get(user.ID)
+	switch {
+	case err == nil:
+		scheduledDeletion = scheduledFor
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	export := map[string]any{
+		"exported_at":    time.Now(),
+		"user":           user,
+		"permissions":    permissions,
+		"sessions":       sessions,
+		"refresh_tokens": refreshTokens,
+		"api_keys":       apiKeys,
+		"two_factor": map[string]any{
+			"enabled": totp != nil && totp.Confirmed,
+		},
+		"pending_email_change": pendingEmail,
+		"scheduled_deletion":   scheduledDeletion,
+	}
+
+	//Suggest that browsers save the response as a file rather than display it
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-user-%d.json"`, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"export": export}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Schedule the current user's account for deletion. This requires the password, and signs the user
+// out everywhere. The account is anonymised once the grace period is over, unless the user logs in
+// again before then.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	scheduledFor := time.Now().Add(app.config.deletion.gracePeriod)
+
+	err = app.models.UserDeletions.Schedule(user.ID, scheduledFor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Sign the user out everywhere, including any JWTs which have already been issued. API keys are
+	//deleted rather than left to expire, so they can't keep the account in use during the grace
+	//period
+	err = app.models.Tokens.RevokeAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.RefreshTokens.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.RevokeJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.APIKeys.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{
+		"message":       "your account has been scheduled for deletion, log in again before then to cancel",
+		"scheduled_for": scheduledFor,
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
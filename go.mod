@@ -15,4 +15,7 @@ require (
 	golang.org/x/crypto v0.42.0
 )
 
-require golang.org/x/text v0.29.0 // indirect
+require (
+	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+)
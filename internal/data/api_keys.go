@@ -0,0 +1,223 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// All API keys start with this prefix, which makes them easy to recognise (for example, by
+// secret scanners) and to tell apart from authentication tokens.
+const apiKeyPrefix = "glk_"
+
+// An APIKey lets a machine client authenticate as a user without their password. Each key only
+// carries a subset of the user's permissions. The plaintext key is only ever available right after
+// the key has been created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitzero"`
+	Hash        []byte      `json:"-"`
+	Prefix      string      `json:"prefix"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// NewAPIKey() returns an APIKey with a freshly generated plaintext key and its hash.
+func NewAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) *APIKey {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Plaintext:   apiKeyPrefix + rand.Text(),
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	//Keep the first few characters of the key so that the user can tell their keys apart
+	key.Prefix = key.Plaintext[:len(apiKeyPrefix)+6]
+
+	return key
+}
+
+// ValidateAPIKey() checks the API key fields, including that every permission on the key is one
+// the user actually holds.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, userPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range key.Permissions {
+		v.Check(userPermissions.Include(code), "permissions", "must only contain permissions that you have")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Check that the plaintext key looks like an API key before we hit the database.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(keyPlaintext) == len(apiKeyPrefix)+26, "key", "must be a valid API key")
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+	INSERT INTO api_keys (user_id, name, hash, prefix, permissions, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Hash, key.Prefix, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser() returns all of a user's API keys, including expired ones.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+	SELECT id, user_id, name, prefix, permissions, created_at, expiry, last_used_at
+	FROM api_keys
+	WHERE user_id = $1
+	ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.CreatedAt,
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForKey() retrieves an unexpired API key from its plaintext value, and records that it has
+// just been used.
+func (m APIKeyModel) GetForKey(keyPlaintext string) (*APIKey, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+	UPDATE api_keys
+	SET last_used_at = NOW()
+	WHERE hash = $1 AND (expiry IS NULL OR expiry > NOW())
+	RETURNING id, user_id, name, prefix, permissions, created_at, expiry, last_used_at`
+
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:]).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.CreatedAt,
+		&key.Expiry,
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
+
+// Delete() removes one of a user's API keys. The user ID is part of the WHERE clause so that users
+// can't delete each other's keys.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM api_keys
+	WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser() removes all of a user's API keys.
+func (m APIKeyModel) DeleteAllForUser(userID int64) error {
+	query := `
+	DELETE FROM api_keys
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
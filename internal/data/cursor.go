@@ -0,0 +1,84 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// A cursor marks a position in a sorted listing by the sort key and id of a row. Pages are then
+// fetched relative to that row (keyset pagination), rather than by skipping a number of rows.
+type cursor struct {
+	Sort   string `json:"s"`
+	Value  string `json:"v"`
+	ID     int64  `json:"i"`
+	Before bool   `json:"b,omitzero"`
+}
+
+// The encodeCursor() method returns the opaque form of a cursor which is given to clients. It is
+// made up of the base64-encoded cursor and an HMAC of it, so that clients can't construct or
+// tamper with cursors.
+func (f Filters) encodeCursor(c cursor) string {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+
+	mac := hmac.New(sha256.New, f.CursorKey)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// The decodeCursor() method checks the signature of the cursor provided by the client and returns
+// the decoded cursor, or nil if no cursor was provided. A cursor is only valid for the sort order
+// it was created with.
+func (f Filters) decodeCursor() (*cursor, error) {
+	if f.Cursor == "" {
+		return nil, nil
+	}
+
+	if len(f.CursorKey) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	encodedPayload, encodedMAC, ok := strings.Cut(f.Cursor, ".")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	providedMAC, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, f.CursorKey)
+	mac.Write(payload)
+
+	if !hmac.Equal(providedMAC, mac.Sum(nil)) {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if c.Sort != f.Sort {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EmailChangeModel stores the new email address a user has asked to change to, until the change
+// has been confirmed with the tokens sent to both the new and the current address. Each user has
+// at most one pending change.
+type EmailChangeModel struct {
+	DB *sql.DB
+}
+
+// Set() records the pending email address for a user, replacing any earlier pending change.
+func (m EmailChangeModel) Set(userID int64, email string) error {
+	query := `
+	INSERT INTO email_changes (user_id, email)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET email = EXCLUDED.email, new_address_confirmed = false, current_address_confirmed = false, created_at = NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, email)
+	return err
+}
+
+// Get() returns the pending email address for a user.
+func (m EmailChangeModel) Get(userID int64) (string, error) {
+	query := `
+	SELECT email
+	FROM email_changes
+	WHERE user_id = $1`
+
+	var email string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return email, nil
+}
+
+// Confirm() records that the pending change has been confirmed from one of the two addresses,
+// depending on the scope of the token that was used: ScopeEmailChange for the new address, or
+// ScopeEmailChangeCurrent for the current one. It returns the new email address, and whether the
+// change has now been confirmed from both addresses.
+func (m EmailChangeModel) Confirm(userID int64, scope string) (string, bool, error) {
+	query := `
+	UPDATE email_changes
+	SET new_address_confirmed = new_address_confirmed OR $2,
+		current_address_confirmed = current_address_confirmed OR $3
+	WHERE user_id = $1
+	RETURNING email, new_address_confirmed AND current_address_confirmed`
+
+	var (
+		email     string
+		confirmed bool
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{userID, scope == ScopeEmailChange, scope == ScopeEmailChangeCurrent}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&email, &confirmed)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", false, ErrRecordNotFound
+		default:
+			return "", false, err
+		}
+	}
+
+	return email, confirmed, nil
+}
+
+func (m EmailChangeModel) Delete(userID int64) error {
+	query := `
+	DELETE FROM email_changes
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
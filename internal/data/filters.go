@@ -1,6 +1,7 @@
 package data
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/arynkh/greenlight/internal/validator"
@@ -11,14 +12,21 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+
+	//Cursor is the opaque cursor provided by the client, if any, and CursorKey is the secret key
+	//used to sign cursors. Cursors are only returned in the metadata if a CursorKey is set
+	Cursor    string
+	CursorKey []byte
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitzero"`
-	PageSize     int `json:"page_size,omitzero"`
-	FirstPage    int `json:"first_page,omitzero"`
-	LastPage     int `json:"last_page,omitzero"`
-	TotalRecords int `json:"total_records,omitzero"`
+	CurrentPage  int    `json:"current_page,omitzero"`
+	PageSize     int    `json:"page_size,omitzero"`
+	FirstPage    int    `json:"first_page,omitzero"`
+	LastPage     int    `json:"last_page,omitzero"`
+	TotalRecords int    `json:"total_records,omitzero"`
+	NextCursor   string `json:"next_cursor,omitzero"`
+	PrevCursor   string `json:"prev_cursor,omitzero"`
 }
 
 // The calculateMetadata() function calculates the appropriate pagination metadata
@@ -68,6 +76,14 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	//A cursor already identifies the position in the listing, so it can't be combined with a page
+	if f.Cursor != "" {
+		v.Check(f.Page == 1, "page", "must not be provided together with a cursor")
+
+		_, err := f.decodeCursor()
+		v.Check(err == nil, "cursor", "must be a cursor returned by a previous request with the same sort")
+	}
 }
 
 func (f Filters) limit() int {
@@ -77,3 +93,37 @@ func (f Filters) limit() int {
 func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
+
+// The keysetCondition() method returns an SQL condition which matches the rows after the cursor
+// position in the sort order (or before it, for a cursor pointing backwards). The placeholders
+// are for the cursor's sort value and id respectively. Ties on the sort column are broken by id.
+func (f Filters) keysetCondition(c *cursor, valuePlaceholder, idPlaceholder string) string {
+	column := f.sortColumn()
+
+	valueOp, idOp := ">", ">"
+	if f.sortDirection() == "DESC" {
+		valueOp = "<"
+	}
+
+	if c.Before {
+		valueOp = map[string]string{">": "<", "<": ">"}[valueOp]
+		idOp = "<"
+	}
+
+	return fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s %s))", column, valueOp, valuePlaceholder, column, valuePlaceholder, idOp, idPlaceholder)
+}
+
+// The orderBy() method returns the ORDER BY expressions for the listing. When paging backwards
+// from a cursor, the order is reversed so that the rows closest to the cursor come first; the
+// caller must reverse the results again before returning them.
+func (f Filters) orderBy(c *cursor) string {
+	if c != nil && c.Before {
+		direction := "DESC"
+		if f.sortDirection() == "DESC" {
+			direction = "ASC"
+		}
+		return fmt.Sprintf("%s %s, id DESC", f.sortColumn(), direction)
+	}
+
+	return fmt.Sprintf("%s %s, id ASC", f.sortColumn(), f.sortDirection())
+}
@@ -0,0 +1,121 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// An OIDCState holds the values generated when a user starts signing in with the identity provider,
+// which we need again when they are redirected back to us.
+type OIDCState struct {
+	Nonce        string
+	CodeVerifier string
+}
+
+// IdentityModel links external identities (an issuer and subject from an ID token) to users, and
+// stores the short-lived state of sign-ins which are in progress.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// InsertState() stores the nonce and PKCE code verifier for a sign-in, keyed by the hash of its
+// state parameter. Sign-ins which are abandoned leave their state behind, so the expired states
+// are cleared out at the same time.
+func (m IdentityModel) InsertState(state string, oidcState OIDCState, ttl time.Duration) error {
+	stateHash := sha256.Sum256([]byte(state))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM oidc_states WHERE expiry < NOW()`)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO oidc_states (state, nonce, code_verifier, expiry)
+	VALUES ($1, $2, $3, $4)`
+
+	args := []any{stateHash[:], oidcState.Nonce, oidcState.CodeVerifier, time.Now().Add(ttl)}
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ConsumeState() retrieves and deletes the stored state for a sign-in, so that each state can only
+// be used once. Unknown and expired states return ErrRecordNotFound.
+func (m IdentityModel) ConsumeState(state string) (*OIDCState, error) {
+	stateHash := sha256.Sum256([]byte(state))
+
+	query := `
+	DELETE FROM oidc_states
+	WHERE state = $1 AND expiry > NOW()
+	RETURNING nonce, code_verifier`
+
+	var oidcState OIDCState
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, stateHash[:]).Scan(&oidcState.Nonce, &oidcState.CodeVerifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &oidcState, nil
+}
+
+// GetUser() returns the user linked to an external identity.
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	FROM users
+	INNER JOIN user_identities ON user_identities.user_id = users.id
+	WHERE user_identities.issuer = $1 AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Link() links an external identity to a user.
+func (m IdentityModel) Link(issuer, subject string, userID int64) error {
+	query := `
+	INSERT INTO user_identities (issuer, subject, user_id)
+	VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID)
+	return err
+}
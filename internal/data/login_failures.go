@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// LoginFailureKeyEmail() and LoginFailureKeyIP() return the keys that failed login attempts are
+// tracked under. Emails are lowercased, to match the case-insensitive citext column in the users table.
+func LoginFailureKeyEmail(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func LoginFailureKeyIP(ip string) string {
+	return "ip:" + ip
+}
+
+// A LockoutPolicy describes when repeated failures lead to a lockout. Once the number of failures
+// reaches Threshold, the key is locked for BaseDuration, which doubles with every further failure
+// up to MaxDuration. Failures are forgotten once there have been none for MaxDuration.
+type LockoutPolicy struct {
+	Threshold    int
+	BaseDuration time.Duration
+	MaxDuration  time.Duration
+}
+
+func (p LockoutPolicy) lockDuration(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+
+	d := p.BaseDuration
+	for i := p.Threshold; i < failures && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+
+	return min(d, p.MaxDuration)
+}
+
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// LockedUntil() returns the time until which the key is locked, or the zero time if it isn't.
+func (m LoginFailureModel) LockedUntil(key string) (time.Time, error) {
+	query := `
+	SELECT locked_until
+	FROM login_failures
+	WHERE key = $1 AND locked_until > NOW()`
+
+	var lockedUntil time.Time
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&lockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, nil
+		default:
+			return time.Time{}, err
+		}
+	}
+
+	return lockedUntil, nil
+}
+
+// RecordFailure() records a failed login attempt for the key and applies the lockout policy.
+// It returns true if this failure caused the key to become locked.
+func (m LoginFailureModel) RecordFailure(key string, policy LockoutPolicy) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	//Start counting again from scratch if the last failure was a long time ago
+	query := `
+	INSERT INTO login_failures (key, failures, last_failure_at)
+	VALUES ($1, 1, NOW())
+	ON CONFLICT (key) DO UPDATE
+	SET failures = CASE
+		WHEN login_failures.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+		ELSE login_failures.failures + 1
+	END,
+	last_failure_at = NOW()
+	RETURNING failures, locked_until`
+
+	var (
+		failures    int
+		lockedUntil sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, key, policy.MaxDuration.Seconds()).Scan(&failures, &lockedUntil)
+	if err != nil {
+		return false, err
+	}
+
+	d := policy.lockDuration(failures)
+	if d == 0 {
+		return false, tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE login_failures SET locked_until = $2 WHERE key = $1`, key, time.Now().Add(d))
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	wasLocked := lockedUntil.Valid && lockedUntil.Time.After(time.Now())
+
+	return !wasLocked, nil
+}
+
+// Reset() forgets all failures for the key, lifting any lockout.
+func (m LoginFailureModel) Reset(key string) error {
+	query := `
+	DELETE FROM login_failures
+	WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
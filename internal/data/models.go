@@ -12,14 +12,32 @@ var (
 
 // Models struct which wraps the MovieModel.
 type Models struct {
-	Movies MovieModel
-	Users  UserModel
+	APIKeys       APIKeyModel
+	EmailChanges  EmailChangeModel
+	Identities    IdentityModel
+	LoginFailures LoginFailureModel
+	Movies        MovieModel
+	Permissions   PermissionModel
+	RefreshTokens RefreshTokenModel
+	TOTP          TOTPModel
+	Tokens        TokenModel
+	UserDeletions UserDeletionModel
+	Users         UserModel
 }
 
 // New() method which returns a Models struct containing the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies: MovieModel{DB: db},
-		Users:  UserModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		EmailChanges:  EmailChangeModel{DB: db},
+		Identities:    IdentityModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		RefreshTokens: RefreshTokenModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		UserDeletions: UserDeletionModel{DB: db},
+		Users:         UserModel{DB: db},
 	}
 }
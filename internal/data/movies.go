@@ -3,8 +3,12 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/arynkh/greenlight/internal/validator"
@@ -20,6 +24,395 @@ type Movie struct {
 	Runtime   Runtime   `json:"runtime,omitzero"`
 	Genres    []string  `json:"genres,omitzero"`
 	Version   int32     `json:"version"`
+	Relevance float64   `json:"relevance,omitzero"` //how well the movie matches the search term, in listings
+	Headline  string    `json:"headline,omitzero"`  //the title with the search terms highlighted, in listings
+	//Similar holds the movies which share the most genres with this one, with expand=similar
+	Similar []*MovieSuggestion `json:"similar,omitzero"`
+}
+
+// MovieFields lists the fields which clients can ask for with the fields parameter, when they only
+// need part of each movie. MovieListFields adds the fields which are only present in listings.
+var (
+	MovieFields     = []string{"id", "title", "year", "runtime", "genres", "version"}
+	MovieListFields = append(slices.Clone(MovieFields), "relevance", "headline")
+)
+
+// MovieExpansions lists the related resources which can be embedded in movie responses with the
+// expand parameter.
+var MovieExpansions = []string{"similar"}
+
+// movieColumns returns the columns to select for the requested fields, which defaults to all of
+// them. The id is always selected, along with any other columns that the caller needs.
+func movieColumns(fields []string, allFields []string, required ...string) []string {
+	if len(fields) == 0 {
+		return allFields
+	}
+
+	columns := []string{"id"}
+	for _, field := range slices.Concat(fields, required) {
+		if !slices.Contains(columns, field) {
+			columns = append(columns, field)
+		}
+	}
+
+	return columns
+}
+
+// The scanDest() method returns the destination to scan the given column into.
+func (movie *Movie) scanDest(column string) any {
+	switch column {
+	case "id":
+		return &movie.ID
+	case "created_at":
+		return &movie.CreatedAt
+	case "title":
+		return &movie.Title
+	case "year":
+		return &movie.Year
+	case "runtime":
+		return &movie.Runtime
+	case "genres":
+		return pq.Array(&movie.Genres)
+	case "version":
+		return &movie.Version
+	case "relevance":
+		return &movie.Relevance
+	case "headline":
+		return &movie.Headline
+	}
+
+	panic("unknown movie column: " + column)
+}
+
+// The Select() method returns a map of just the requested fields of the movie, for encoding as
+// JSON in place of the whole movie. Fields are included even if they hold a zero value.
+func (movie *Movie) Select(fields []string) map[string]any {
+	selected := make(map[string]any, len(fields))
+
+	for _, field := range fields {
+		switch field {
+		case "id":
+			selected[field] = movie.ID
+		case "title":
+			selected[field] = movie.Title
+		case "year":
+			selected[field] = movie.Year
+		case "runtime":
+			selected[field] = movie.Runtime
+		case "genres":
+			selected[field] = movie.Genres
+		case "version":
+			selected[field] = movie.Version
+		case "relevance":
+			selected[field] = movie.Relevance
+		case "headline":
+			selected[field] = movie.Headline
+		case "similar":
+			selected[field] = movie.Similar
+		}
+	}
+
+	return selected
+}
+
+// Expand() loads the requested related resources for each of the movies. Each expansion is
+// loaded for all of the movies at once, so that a listing doesn't cost a query per movie.
+func (m MovieModel) Expand(movies []*Movie, expansions []string) error {
+	for _, expansion := range expansions {
+		switch expansion {
+		case "similar":
+			err := m.expandSimilar(movies)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported expansion %q", expansion)
+		}
+	}
+
+	return nil
+}
+
+// expandSimilar() finds up to 5 other movies for each movie which share at least one genre with
+// it, most shared genres first. The genres && operator can use the GIN index on genres.
+func (m MovieModel) expandSimilar(movies []*Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(movies))
+	byID := make(map[int64]*Movie, len(movies))
+
+	for i, movie := range movies {
+		ids[i] = movie.ID
+		byID[movie.ID] = movie
+		movie.Similar = []*MovieSuggestion{}
+	}
+
+	query := `
+		SELECT source.id, similar.id, similar.title, similar.year
+		FROM movies AS source
+		CROSS JOIN LATERAL (
+			SELECT id, title, year, cardinality(ARRAY(SELECT unnest(genres) INTERSECT SELECT unnest(source.genres))) AS shared
+			FROM movies
+			WHERE id <> source.id AND genres && source.genres
+			ORDER BY shared DESC, id
+			LIMIT 5
+		) AS similar
+		WHERE source.id = ANY($1)
+		ORDER BY source.id, similar.shared DESC, similar.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			sourceID int64
+			similar  MovieSuggestion
+		)
+
+		err := rows.Scan(&sourceID, &similar.ID, &similar.Title, &similar.Year)
+		if err != nil {
+			return err
+		}
+
+		byID[sourceID].Similar = append(byID[sourceID].Similar, &similar)
+	}
+
+	return rows.Err()
+}
+
+// ValidateFields checks that all of the fields requested by the client are in the safelist.
+func ValidateFields(v *validator.Validator, key string, fields []string, safelist []string) {
+	message := "must only contain " + strings.Join(safelist, ", ")
+	if len(safelist) == 0 {
+		message = "is not supported"
+	}
+
+	for _, field := range fields {
+		v.Check(validator.PermittedValue(field, safelist...), key, message)
+	}
+	v.Check(validator.Unique(fields), key, "must not contain duplicate values")
+}
+
+// MovieSuggestion is the lightweight form of a movie returned for title autocompletion.
+type MovieSuggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+// FacetCount is the number of movies in a listing which fall into one value of a facet, such as
+// one genre or one decade.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// MovieFacets lists the facets which can be requested for a movie listing.
+var MovieFacets = []string{"genres", "decade", "runtime_bucket"}
+
+// The facetQueries map holds the query for each facet, which counts the rows in the matches CTE.
+// Each returns the facet name, the value, the count and the position of the value in the order we
+// want to present them in.
+var facetQueries = map[string]string{
+	//Genres are ordered with the most common first
+	"genres": `
+		SELECT 'genres', genre, count(*), row_number() OVER (ORDER BY count(*) DESC, genre)
+		FROM matches, unnest(genres) AS genre
+		GROUP BY genre`,
+	"decade": `
+		SELECT 'decade', (year / 10 * 10)::text || 's', count(*), year / 10
+		FROM matches
+		GROUP BY year / 10`,
+	"runtime_bucket": `
+		SELECT 'runtime_bucket', (ARRAY['0-89', '90-119', '120-149', '150+'])[width_bucket(runtime, ARRAY[90, 120, 150]) + 1], count(*), width_bucket(runtime, ARRAY[90, 120, 150])
+		FROM matches
+		GROUP BY width_bucket(runtime, ARRAY[90, 120, 150])`,
+}
+
+// movieColumnPlaceholders holds a value of the right type for each column of the listing, to stand
+// in for the NULLs in the row which carries the facets when the page is empty. Real movies never
+// have an ID of 0, so that row can be told apart from them.
+var movieColumnPlaceholders = map[string]string{
+	"id":         "0",
+	"created_at": "'epoch'",
+	"title":      "''",
+	"year":       "0",
+	"runtime":    "0",
+	"genres":     "'{}'",
+	"version":    "0",
+	"relevance":  "0",
+	"headline":   "''",
+}
+
+// SearchLanguages lists the text search configurations which can be used for full-text search.
+// The "simple" configuration doesn't do any stemming, which suits titles in any language.
+var SearchLanguages = []string{"simple", "danish", "dutch", "english", "finnish", "french", "german", "italian", "norwegian", "portuguese", "russian", "spanish", "swedish"}
+
+// MovieFilters holds the conditions used to narrow down the movie listing. Zero values mean that
+// the corresponding filter isn't applied.
+type MovieFilters struct {
+	Title         string   //searches the titles only
+	Search        string   //searches the titles and genres together, always in fulltext mode
+	SearchMode    string   //"fulltext" matches whole words, "fuzzy" tolerates typos and partial words
+	Language      string   //the text search configuration used in fulltext mode
+	Genres        []string //movies must have all of these genres
+	GenresAny     []string //movies must have at least one of these genres
+	ExcludeGenres []string //movies must have none of these genres
+	YearMin       int
+	YearMax       int
+	RuntimeMin    int
+	RuntimeMax    int
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func ValidateMovieFilters(v *validator.Validator, mf MovieFilters) {
+	v.Check(validator.PermittedValue(mf.SearchMode, "fulltext", "fuzzy"), "search_mode", "must be fulltext or fuzzy")
+	v.Check(validator.PermittedValue(mf.Language, SearchLanguages...), "lang", "must be a supported language: "+strings.Join(SearchLanguages, ", "))
+	v.Check(mf.Title == "" || mf.Search == "", "q", "must not be used together with title")
+
+	if mf.YearMin != 0 {
+		v.Check(mf.YearMin >= 1888, "year_min", "must be greater than 1888")
+	}
+	if mf.YearMax != 0 {
+		v.Check(mf.YearMax >= 1888, "year_max", "must be greater than 1888")
+	}
+	if mf.YearMin != 0 && mf.YearMax != 0 {
+		v.Check(mf.YearMin <= mf.YearMax, "year_min", "must not be greater than year_max")
+	}
+
+	if mf.RuntimeMin != 0 {
+		v.Check(mf.RuntimeMin > 0, "runtime_min", "must be a positive integer")
+	}
+	if mf.RuntimeMax != 0 {
+		v.Check(mf.RuntimeMax > 0, "runtime_max", "must be a positive integer")
+	}
+	if mf.RuntimeMin != 0 && mf.RuntimeMax != 0 {
+		v.Check(mf.RuntimeMin <= mf.RuntimeMax, "runtime_min", "must not be greater than runtime_max")
+	}
+
+	v.Check(len(mf.Genres) <= 20, "genres", "must not contain more than 20 values")
+	v.Check(len(mf.GenresAny) <= 20, "genres_any", "must not contain more than 20 values")
+	v.Check(len(mf.ExcludeGenres) <= 20, "exclude_genres", "must not contain more than 20 values")
+
+	if !mf.CreatedAfter.IsZero() && !mf.CreatedBefore.IsZero() {
+		v.Check(mf.CreatedAfter.Before(mf.CreatedBefore), "created_after", "must be before created_before")
+	}
+}
+
+// movieQuery holds the parts of an SQL query which are generated from MovieFilters.
+type movieQuery struct {
+	conditions []string //to be joined with AND
+	relevance  string   //an expression for how well a movie matches the search term
+	headline   string   //an expression for the title with the search terms highlighted
+	args       []any    //the values for the placeholders
+}
+
+// The query() method translates the filters into SQL conditions and expressions, and the values
+// for their placeholders. Placeholder numbering continues on from the args passed in, so that the
+// caller can add further conditions afterwards. Without a search term, the relevance is 0 and the
+// headline is empty.
+func (mf MovieFilters) query(args []any) movieQuery {
+	var conditions []string
+	relevance, headline := "0::real", "''"
+
+	//add() appends a condition containing a single placeholder, written as $%[1]d so that the
+	//placeholder can be referenced more than once
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	//fulltext() adds a websearch_to_tsquery() condition, which supports "quoted phrases", OR and
+	//-excluded words, and ranks the matches with ts_rank_cd(). The configuration comes from the
+	//SearchLanguages safelist, and is written into the query as a literal rather than passed as a
+	//parameter, so that the planner can match it against expression indexes
+	config := pq.QuoteLiteral(mf.Language) + "::regconfig"
+
+	fulltext := func(vector, text string) {
+		args = append(args, text)
+		tsquery := fmt.Sprintf("websearch_to_tsquery(%s, $%d)", config, len(args))
+
+		conditions = append(conditions, fmt.Sprintf("%s @@ %s", vector, tsquery))
+		relevance = fmt.Sprintf("ts_rank_cd(%s, %s)", vector, tsquery)
+		headline = fmt.Sprintf("ts_headline(%s, title, %s, 'HighlightAll=true')", config, tsquery)
+	}
+
+	switch {
+	case mf.Title == "":
+	case mf.SearchMode == "fuzzy":
+		//The <% operator matches titles containing a word similar to the search term, which
+		//makes use of the trigram index on title
+		add(`$%[1]d <%% title`, mf.Title)
+		relevance = fmt.Sprintf("word_similarity($%d, title)", len(args))
+	default:
+		//Only the title is searched. The expression index on to_tsvector('simple', title) covers
+		//the default configuration; other languages scan the whole table unless an index on
+		//to_tsvector('<language>', title) has been added for them
+		fulltext(fmt.Sprintf("to_tsvector(%s, title)", config), mf.Title)
+	}
+
+	//The q parameter searches the title and the genres, with title matches ranked higher. The
+	//stored (and indexed) search vector uses the simple configuration, so for other languages
+	//the vector is calculated for every row, which means a full scan
+	if mf.Search != "" {
+		vector := "search_vector"
+		if mf.Language != "simple" {
+			vector = fmt.Sprintf("movies_search_vector(%s, title, genres)", config)
+		}
+
+		fulltext(vector, mf.Search)
+	}
+	if len(mf.Genres) > 0 {
+		add(`genres @> $%[1]d`, pq.Array(mf.Genres))
+	}
+	if len(mf.GenresAny) > 0 {
+		add(`genres && $%[1]d`, pq.Array(mf.GenresAny))
+	}
+	if len(mf.ExcludeGenres) > 0 {
+		add(`NOT (genres && $%[1]d)`, pq.Array(mf.ExcludeGenres))
+	}
+	if mf.YearMin != 0 {
+		add(`year >= $%[1]d`, mf.YearMin)
+	}
+	if mf.YearMax != 0 {
+		add(`year <= $%[1]d`, mf.YearMax)
+	}
+	if mf.RuntimeMin != 0 {
+		add(`runtime >= $%[1]d`, mf.RuntimeMin)
+	}
+	if mf.RuntimeMax != 0 {
+		add(`runtime <= $%[1]d`, mf.RuntimeMax)
+	}
+	if !mf.CreatedAfter.IsZero() {
+		add(`created_at > $%[1]d`, mf.CreatedAfter)
+	}
+	if !mf.CreatedBefore.IsZero() {
+		add(`created_at < $%[1]d`, mf.CreatedBefore)
+	}
+
+	return movieQuery{conditions: conditions, relevance: relevance, headline: headline, args: args}
+}
+
+// likeEscaper escapes the characters which have a special meaning in LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// whereClause() joins SQL conditions into a WHERE clause, or returns an empty string if there
+// aren't any.
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+
+	return "WHERE " + strings.Join(conditions, "\n\t\tAND ")
 }
 
 type MovieModel struct {
@@ -58,33 +451,34 @@ func (m MovieModel) Insert(movie *Movie) error {
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+// Get() returns the movie with the given id. Only the requested fields (and the version, which is
+// needed for the ETag) are fetched, or all of them if no fields are given.
+func (m MovieModel) Get(id int64, fields ...string) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+	columns := movieColumns(fields, []string{"id", "created_at", "title", "year", "runtime", "genres", "version"}, "version")
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM movies
-		WHERE id = $1`
+		WHERE id = $1`, strings.Join(columns, ", "))
 
 	//define a Movie struct to hold the data returned by the query
 	var movie Movie
 
+	dest := make([]any, len(columns))
+	for i, column := range columns {
+		dest[i] = movie.scanDest(column)
+	}
+
 	// Use the context.WithTimeout() function to create a context.Context which carries a
 	// 3-second timeout deadline.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(dest...)
 
 	if err != nil {
 		switch {
@@ -130,6 +524,33 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
+// DeleteVersion() deletes a movie only if it is still at the given version, returning
+// ErrEditConflict if it has been changed (or deleted) since.
+func (m MovieModel) DeleteVersion(id int64, version int32) error {
+	query := `
+		DELETE FROM movies
+		WHERE id = $1 AND version = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
 func (m MovieModel) Delete(id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
@@ -160,23 +581,125 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+// GetAll() returns a page of movies matching the movie filters. Pages are selected
+// either by page number, or by a cursor from the metadata of a previous page, which stays fast on
+// deep pages and doesn't skip or repeat rows when movies are added in the meantime. Only the
+// requested fields are fetched, or all of them if no fields are given.
+func (m MovieModel) GetAll(mf MovieFilters, filters Filters, fields ...string) ([]*Movie, Metadata, error) {
+	movies, metadata, _, err := m.getAll(mf, filters, nil, fields)
+	return movies, metadata, err
+}
+
+// GetAllWithFacets() returns a page of movies like GetAll(), along with the counts for the
+// requested facets. The page and the facets are read in a single statement, so they see the same
+// snapshot of the data and the facet counts always agree with the movies listed.
+func (m MovieModel) GetAllWithFacets(mf MovieFilters, filters Filters, facets []string, fields ...string) ([]*Movie, Metadata, map[string][]FacetCount, error) {
+	return m.getAll(mf, filters, facets, fields)
+}
+
+// getAll() runs the query for GetAll() and GetAllWithFacets(). The facet counts are only
+// calculated if some facets are requested, otherwise the returned map is nil.
+func (m MovieModel) getAll(mf MovieFilters, filters Filters, facets []string, fields []string) ([]*Movie, Metadata, map[string][]FacetCount, error) {
+	cursor, err := filters.decodeCursor()
+	if err != nil {
+		return nil, Metadata{}, nil, err
+	}
+
+	var facetSelects []string
+	for _, facet := range facets {
+		facetQuery, ok := facetQueries[facet]
+		if !ok {
+			return nil, Metadata{}, nil, fmt.Errorf("unsupported facet %q", facet)
+		}
+		facetSelects = append(facetSelects, facetQuery)
+	}
+
+	mq := mf.query(nil)
+	args := mq.args
+
+	//The keyset condition for a cursor goes in the outer query, so that it can refer to the
+	//relevance of each movie when sorting by it
+	var keyset []string
+
+	//In cursor mode the total isn't counted, as that would mean visiting every matching row, and
+	//one extra row is fetched to find out whether there is another page after this one
+	countColumn := "count(*) OVER()"
+	limit, offset := filters.limit(), filters.offset()
+
+	if cursor != nil {
+		args = append(args, cursor.Value, cursor.ID)
+		countColumn = "0"
+		keyset = append(keyset, filters.keysetCondition(cursor, fmt.Sprintf("$%d", len(args)-1), fmt.Sprintf("$%d", len(args))))
+		limit, offset = filters.limit()+1, 0
+	}
+
+	args = append(args, limit, offset)
+
+	//The sort column is needed to create cursors, even if the client didn't ask for it. The
+	//headline is the only column that is calculated here in the outer query, so that it's only
+	//worked out for the movies on the page
+	columns := movieColumns(fields, []string{"id", "created_at", "title", "year", "runtime", "genres", "version", "relevance", "headline"}, filters.sortColumn())
+
+	selectList := make([]string, len(columns))
+	for i, column := range columns {
+		selectList[i] = column
+		if column == "headline" {
+			selectList[i] = mq.headline + " AS headline"
+		}
+	}
+
+	matches := fmt.Sprintf(`
+		SELECT id, created_at, title, year, runtime, genres, version, %s AS relevance
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
-		AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		%s`, mq.relevance, whereClause(mq.conditions))
+
+	//With facets, the matching movies are collected once in the matches CTE, and both the page
+	//and the facet counts are read from it
+	source := "(" + matches + "\n\t\t) AS movies"
+	if len(facets) > 0 {
+		source = "matches AS movies"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s AS total_records, %s
+		FROM %s
+		%s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`, countColumn, strings.Join(selectList, ", "), source, whereClause(keyset), filters.orderBy(cursor), len(args)-1, len(args))
+
+	//The facets are aggregated into a single JSON value, which is joined onto every row of the
+	//page. It's a LEFT JOIN so that there is still a row to carry the facets when the page is
+	//empty; in that row the movie columns are NULL, and are replaced with placeholder values
+	//which the loop below skips
+	if len(facets) > 0 {
+		outerList := []string{"COALESCE(total_records, 0)"}
+		for _, column := range columns {
+			outerList = append(outerList, fmt.Sprintf("COALESCE(page.%s, %s)", column, movieColumnPlaceholders[column]))
+		}
+		outerList = append(outerList, "facet_counts.facets")
+
+		query = fmt.Sprintf(`
+		WITH matches AS MATERIALIZED (%s
+		),
+		page AS (%s
+		),
+		facet_counts AS (
+			SELECT COALESCE(json_agg(json_build_object('facet', facet, 'value', value, 'count', count) ORDER BY facet, position), '[]') AS facets
+			FROM (%s
+			) AS counts (facet, value, count, position)
+		)
+		SELECT %s
+		FROM facet_counts
+		LEFT JOIN page ON true
+		ORDER BY %s`, matches, query, strings.Join(facetSelects, "\n\t\t\tUNION ALL"), strings.Join(outerList, ", "), filters.orderBy(cursor))
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
-
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, nil, err
 	}
 
 	defer rows.Close()
@@ -184,34 +707,172 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	totalRecords := 0
 	//empty slice to hold the movie data
 	movies := []*Movie{}
+	var facetsJSON []byte
 
 	for rows.Next() {
 		//initalize an empty Movie struct to hold the data for an individual movie
 		var movie Movie
 
+		dest := []any{&totalRecords}
+		for _, column := range columns {
+			dest = append(dest, movie.scanDest(column))
+		}
+		if len(facets) > 0 {
+			dest = append(dest, &facetsJSON)
+		}
+
 		//scan the values from the row into the Movie struct
-		err := rows.Scan(
-			&totalRecords,
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		err := rows.Scan(dest...)
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, Metadata{}, nil, err
+		}
+
+		//Only the placeholder row for an empty page has an ID of 0
+		if movie.ID == 0 {
+			continue
 		}
 
 		movies = append(movies, &movie)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, nil, err
+	}
+
+	var counts map[string][]FacetCount
+	if len(facets) > 0 {
+		counts, err = decodeFacets(facets, facetsJSON)
+		if err != nil {
+			return nil, Metadata{}, nil, err
+		}
+	}
+
+	if cursor == nil {
+		metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+		//Also hand out cursors, so that clients can switch over to cursor mode after the first page
+		if len(movies) > 0 && len(filters.CursorKey) > 0 {
+			if filters.Page < metadata.LastPage {
+				metadata.NextCursor = filters.movieCursor(movies[len(movies)-1], false)
+			}
+			if filters.Page > 1 {
+				metadata.PrevCursor = filters.movieCursor(movies[0], true)
+			}
+		}
+
+		return movies, metadata, counts, nil
+	}
+
+	if len(movies) == 0 {
+		return movies, Metadata{}, counts, nil
+	}
+
+	hasMore := len(movies) > filters.limit()
+	if hasMore {
+		movies = movies[:filters.limit()]
+	}
+
+	//When paging backwards the rows were fetched in reverse order
+	if cursor.Before {
+		slices.Reverse(movies)
+	}
+
+	//We got here from a cursor, so there are rows on the far side of it. Whether there are more
+	//rows beyond this page in the direction of travel is given by the extra row
+	metadata := Metadata{PageSize: filters.PageSize}
+
+	if !cursor.Before || hasMore {
+		metadata.PrevCursor = filters.movieCursor(movies[0], true)
+	}
+	if cursor.Before || hasMore {
+		metadata.NextCursor = filters.movieCursor(movies[len(movies)-1], false)
+	}
+
+	return movies, metadata, counts, nil
+}
+
+// movieCursor() returns a cursor pointing after (or before) the given movie in the sort order.
+func (f Filters) movieCursor(movie *Movie, before bool) string {
+	var value string
+
+	switch f.sortColumn() {
+	case "title":
+		value = movie.Title
+	case "year":
+		value = strconv.Itoa(int(movie.Year))
+	case "runtime":
+		value = strconv.Itoa(int(movie.Runtime))
+	case "relevance":
+		value = strconv.FormatFloat(movie.Relevance, 'g', -1, 64)
+	default:
+		value = strconv.FormatInt(movie.ID, 10)
+	}
+
+	return f.encodeCursor(cursor{Sort: f.Sort, Value: value, ID: movie.ID, Before: before})
+}
+
+// Suggest() returns up to limit movies whose title starts with the given prefix, ignoring case.
+// Shorter titles come first, as they are the closest matches for the prefix.
+func (m MovieModel) Suggest(prefix string, limit int) ([]*MovieSuggestion, error) {
+	//The lower(title) LIKE 'prefix%' condition can use the text_pattern_ops index on lower(title)
+	query := `
+		SELECT id, title, year
+		FROM movies
+		WHERE lower(title) LIKE lower($1) || '%'
+		ORDER BY length(title), lower(title), id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, likeEscaper.Replace(prefix), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*MovieSuggestion{}
+
+	for rows.Next() {
+		var suggestion MovieSuggestion
+
+		err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year)
+		if err != nil {
+			return nil, err
+		}
+
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
+// decodeFacets() reads the facet counts aggregated by the listing query, which are a JSON array
+// of objects with the facet, value and count, already in the order they are presented in.
+func decodeFacets(facets []string, facetsJSON []byte) (map[string][]FacetCount, error) {
+	var rows []struct {
+		Facet string `json:"facet"`
+		FacetCount
+	}
+
+	err := json.Unmarshal(facetsJSON, &rows)
+	if err != nil {
+		return nil, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	//Include every requested facet in the result, even if no movies match
+	result := make(map[string][]FacetCount, len(facets))
+	for _, facet := range facets {
+		result[facet] = []FacetCount{}
+	}
+
+	for _, row := range rows {
+		result[row.Facet] = append(result[row.Facet], row.FacetCount)
+	}
 
-	return movies, metadata, nil
+	return result, nil
 }
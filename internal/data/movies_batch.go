@@ -0,0 +1,357 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// ErrBatchRolledBack is returned by MovieModel.Batch() in atomic mode when one of the operations
+// failed, and so none of them were applied.
+var ErrBatchRolledBack = errors.New("batch rolled back")
+
+// MovieChanges holds the fields of a movie to set when creating or updating it. The pointers let
+// us tell the difference between a field that isn't present and one with a zero value.
+type MovieChanges struct {
+	Title   *string  `json:"title"`
+	Year    *int32   `json:"year"`
+	Runtime *Runtime `json:"runtime"`
+	Genres  []string `json:"genres"`
+}
+
+// The Apply() method copies the fields which are present onto the movie.
+func (c MovieChanges) Apply(movie *Movie) {
+	if c.Title != nil {
+		movie.Title = *c.Title
+	}
+	if c.Year != nil {
+		movie.Year = *c.Year
+	}
+	if c.Runtime != nil {
+		movie.Runtime = *c.Runtime
+	}
+	if c.Genres != nil {
+		movie.Genres = c.Genres
+	}
+}
+
+// A BatchOperation is one create, update or delete in a batch. Index is the position of the
+// operation in the client's request, which is used to match up the results.
+type BatchOperation struct {
+	Index   int
+	Op      string //create|update|delete
+	ID      int64
+	Version int32 //if set, the update or delete only goes ahead if the movie is at this version
+	Changes MovieChanges
+}
+
+// BatchResult is the outcome of one operation in a batch.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"` //created|updated|deleted|failed|rolled_back
+	Movie  *Movie `json:"movie,omitzero"`
+	Error  any    `json:"error,omitzero"`
+	//Err is the database error behind a failed operation, if any. It is kept for logging, but
+	//isn't shown to the client
+	Err error `json:"-"`
+}
+
+// fail() marks the result as failed because of a database error.
+func (r *BatchResult) fail(err error) {
+	r.Status = "failed"
+	r.Movie = nil
+	r.Error = "the server encountered a problem and could not carry out this operation"
+	r.Err = err
+}
+
+// dbtx is the subset of methods shared by sql.DB and sql.Tx, so that the batch operations can run
+// either inside or outside of a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Batch() runs a batch of movie operations. All of the creates are carried out first, with a
+// single multi-row INSERT, followed by the updates and deletes in the order given.
+//
+// In atomic mode the batch runs in a transaction, and if any operation fails the whole batch is
+// rolled back and ErrBatchRolledBack is returned along with the results, while a database error
+// is returned on its own. Otherwise each operation succeeds or fails on its own, and database
+// errors are recorded in the results of the operations they affected. Create operations must
+// already have been validated.
+func (m MovieModel) Batch(ops []BatchOperation, atomic bool) ([]BatchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var db dbtx = m.DB
+	var tx *sql.Tx
+
+	if atomic {
+		var err error
+
+		tx, err = m.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		//Rollback() is a no-op once the transaction has been committed
+		defer tx.Rollback()
+
+		db = tx
+	}
+
+	results := make([]BatchResult, len(ops))
+	failed := false
+
+	var creates []*Movie
+	var createResults []*BatchResult
+
+	for i, op := range ops {
+		results[i] = BatchResult{Index: op.Index}
+
+		if op.Op == "create" {
+			movie := &Movie{}
+			op.Changes.Apply(movie)
+
+			creates = append(creates, movie)
+			createResults = append(createResults, &results[i])
+		}
+	}
+
+	err := insertMovies(ctx, db, creates)
+	switch {
+	case err != nil && atomic:
+		return nil, err
+	case err != nil:
+		for _, result := range createResults {
+			result.fail(err)
+		}
+	default:
+		for i, movie := range creates {
+			createResults[i].Status = "created"
+			createResults[i].Movie = movie
+		}
+	}
+
+	for i, op := range ops {
+		if failed && atomic {
+			break
+		}
+
+		var opErr any
+
+		switch op.Op {
+		case "create":
+			continue
+		case "update":
+			results[i].Movie, opErr, err = updateMovie(ctx, db, op)
+			results[i].Status = "updated"
+		case "delete":
+			opErr, err = deleteMovie(ctx, db, op)
+			results[i].Status = "deleted"
+		default:
+			panic("unknown batch operation: " + op.Op)
+		}
+
+		if err != nil {
+			if atomic {
+				return nil, err
+			}
+			results[i].fail(err)
+			continue
+		}
+
+		if opErr != nil {
+			results[i].Status = "failed"
+			results[i].Movie = nil
+			results[i].Error = opErr
+			failed = true
+		}
+	}
+
+	if atomic && failed {
+		for i := range results {
+			if results[i].Status != "failed" {
+				results[i].Status = "rolled_back"
+				results[i].Movie = nil
+			}
+		}
+		return results, ErrBatchRolledBack
+	}
+
+	if atomic {
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// insertMovies() inserts the movies with a single INSERT statement, and sets their id, created_at
+// and version fields. The movies are sent as one array per column and unnested WITH ORDINALITY, so
+// the statement has the same 4 parameters however many movies there are. PostgreSQL doesn't
+// promise that RETURNING gives the rows back in any particular order, so the ids are drawn from
+// the sequence up front and joined back to each movie's position.
+func insertMovies(ctx context.Context, db dbtx, movies []*Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	titles := make([]string, len(movies))
+	years := make([]int64, len(movies))
+	runtimes := make([]int64, len(movies))
+	//unnest() would flatten a two dimensional array, so each movie's genres are sent as an array
+	//literal instead, and cast back to text[] in the query
+	genres := make([]string, len(movies))
+
+	for i, movie := range movies {
+		titles[i] = movie.Title
+		years[i] = int64(movie.Year)
+		runtimes[i] = int64(movie.Runtime)
+
+		literal, err := pq.StringArray(movie.Genres).Value()
+		if err != nil {
+			return err
+		}
+		genres[i], _ = literal.(string)
+	}
+
+	query := `
+		WITH input AS MATERIALIZED (
+			SELECT nextval(pg_get_serial_sequence('movies', 'id')) AS id, ord, title, year, runtime, genres::text[] AS genres
+			FROM unnest($1::text[], $2::integer[], $3::integer[], $4::text[]) WITH ORDINALITY AS m (title, year, runtime, genres, ord)
+		), inserted AS (
+			INSERT INTO movies (id, title, year, runtime, genres)
+			SELECT id, title, year, runtime, genres
+			FROM input
+			RETURNING id, created_at, version
+		)
+		SELECT input.ord, inserted.id, inserted.created_at, inserted.version
+		FROM inserted
+		INNER JOIN input ON input.id = inserted.id`
+
+	args := []any{pq.Array(titles), pq.Array(years), pq.Array(runtimes), pq.Array(genres)}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			ord   int
+			movie Movie
+		)
+
+		err := rows.Scan(&ord, &movie.ID, &movie.CreatedAt, &movie.Version)
+		if err != nil {
+			return err
+		}
+
+		//WITH ORDINALITY counts from 1
+		movies[ord-1].ID = movie.ID
+		movies[ord-1].CreatedAt = movie.CreatedAt
+		movies[ord-1].Version = movie.Version
+	}
+
+	return rows.Err()
+}
+
+// updateMovie() applies the changes in a batch update operation. Problems with the operation
+// itself, such as the movie not existing or failing validation, are returned as the second value
+// so that they can be reported to the client, while the error is only for database errors.
+func updateMovie(ctx context.Context, db dbtx, op BatchOperation) (*Movie, any, error) {
+	//Lock the row (when in a transaction) so that it can't change between reading and updating it
+	query := `
+		SELECT id, created_at, title, year, runtime, genres, version
+		FROM movies
+		WHERE id = $1
+		FOR UPDATE`
+
+	var movie Movie
+
+	err := db.QueryRowContext(ctx, query, op.ID).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "movie not found", nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if op.Version != 0 && op.Version != movie.Version {
+		return nil, "movie has been modified since the given version", nil
+	}
+
+	op.Changes.Apply(&movie)
+
+	v := validator.New()
+
+	if ValidateMovie(v, &movie); !v.Valid() {
+		return nil, v.Errors, nil
+	}
+
+	query = `
+		UPDATE movies
+		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
+
+	err = db.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "unable to update the movie due to an edit conflict", nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &movie, nil, nil
+}
+
+// deleteMovie() carries out a batch delete operation, returning problems with the operation in
+// the same way as updateMovie().
+func deleteMovie(ctx context.Context, db dbtx, op BatchOperation) (any, error) {
+	query := `
+		DELETE FROM movies
+		WHERE id = $1 AND (version = $2 OR $2 = 0)`
+
+	result, err := db.ExecContext(ctx, query, op.ID, op.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		if op.Version != 0 {
+			return "movie not found, or has been modified since the given version", nil
+		}
+		return "movie not found", nil
+	}
+
+	return nil, nil
+}
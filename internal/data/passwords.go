@@ -0,0 +1,109 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Argon2Params holds the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordParams are the parameters used for hashing new passwords. They default to the values
+// recommended by OWASP and can be overridden at startup. Existing hashes made with different
+// parameters keep working, and are upgraded the next time the user logs in.
+var PasswordParams = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// hashArgon2id() hashes the password with the given parameters and encodes the result in the PHC
+// string format, for example "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>". The format is
+// self-describing, so a hash can always be verified even after the parameters have changed.
+func hashArgon2id(plaintextPassword string, params Argon2Params) ([]byte, error) {
+	salt := make([]byte, params.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	encoded := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(encoded), nil
+}
+
+// decodeArgon2id() parses a PHC-formatted argon2id hash into its parameters, salt and key.
+func decodeArgon2id(hash []byte) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	params.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// compareArgon2id() checks a plaintext password against a PHC-formatted argon2id hash.
+func compareArgon2id(hash []byte, plaintextPassword string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	//Use subtle.ConstantTimeCompare() so that the comparison doesn't leak timing information
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
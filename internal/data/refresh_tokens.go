@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// A RefreshToken is a long-lived, single-use token which can be exchanged for a new access
+// token. Every refresh token belongs to a family: the token issued at login starts a new family,
+// and each rotation issues a replacement token in the same family.
+type RefreshToken struct {
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Family    string    `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+func generateRefreshToken(userID int64, family string, ttl time.Duration) *RefreshToken {
+	token := &RefreshToken{
+		Plaintext: rand.Text(),
+		UserID:    userID,
+		Family:    family,
+		Expiry:    time.Now().Add(ttl),
+	}
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token
+}
+
+// RefreshTokenInfo describes a refresh token without exposing the token itself.
+type RefreshTokenInfo struct {
+	Family    string     `json:"family"`
+	CreatedAt time.Time  `json:"created_at"`
+	Expiry    time.Time  `json:"expiry"`
+	UsedAt    *time.Time `json:"used_at"`
+	Revoked   bool       `json:"revoked"`
+}
+
+type RefreshTokenModel struct {
+	DB *sql.DB
+}
+
+// New() creates a refresh token which starts a new token family for the user.
+func (m RefreshTokenModel) New(userID int64, ttl time.Duration) (*RefreshToken, error) {
+	token := generateRefreshToken(userID, rand.Text(), ttl)
+
+	query := `
+	INSERT INTO refresh_tokens (hash, user_id, family, expiry)
+	VALUES ($1, $2, $3, $4)`
+
+	args := []any{token.Hash, token.UserID, token.Family, token.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return token, err
+}
+
+// Rotate() exchanges a refresh token for a new one in the same family. The presented token is
+// marked as used, so it can only ever be exchanged once. If a token which has already been used
+// is presented again then it has most likely been stolen, so the whole family is revoked and
+// ErrRefreshTokenReused is returned. Unknown, expired and revoked tokens return ErrRecordNotFound.
+func (m RefreshTokenModel) Rotate(tokenPlaintext string, ttl time.Duration) (*RefreshToken, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	//Lock the row so that two concurrent requests presenting the same token can't both rotate it
+	query := `
+	SELECT user_id, family, expiry, used_at, revoked
+	FROM refresh_tokens
+	WHERE hash = $1
+	FOR UPDATE`
+
+	var (
+		userID  int64
+		family  string
+		expiry  time.Time
+		usedAt  sql.NullTime
+		revoked bool
+	)
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:]).Scan(&userID, &family, &expiry, &usedAt, &revoked)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if revoked || time.Now().After(expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	//The token has been used before, so revoke every token in the family and commit that change
+	//before reporting the reuse
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = true WHERE family = $1`, family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrRefreshTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	token := generateRefreshToken(userID, family, ttl)
+
+	query = `
+	INSERT INTO refresh_tokens (hash, user_id, family, expiry)
+	VALUES ($1, $2, $3, $4)`
+
+	_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Family, token.Expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// DeleteAllForUser() deletes every refresh token for a specific user.
+func (m RefreshTokenModel) DeleteAllForUser(userID int64) error {
+	query := `
+	DELETE FROM refresh_tokens
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// GetAllForUser() returns metadata about all of a user's refresh tokens, most recent first.
+func (m RefreshTokenModel) GetAllForUser(userID int64) ([]*RefreshTokenInfo, error) {
+	query := `
+	SELECT family, created_at, expiry, used_at, revoked
+	FROM refresh_tokens
+	WHERE user_id = $1
+	ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*RefreshTokenInfo{}
+
+	for rows.Next() {
+		var token RefreshTokenInfo
+
+		err := rows.Scan(&token.Family, &token.CreatedAt, &token.Expiry, &token.UsedAt, &token.Revoked)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,221 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/validator"
+)
+
+// Define constants for the token scope.
+const (
+	ScopeActivation         = "activation"
+	ScopeAuthentication     = "authentication"
+	ScopePasswordReset      = "password-reset"
+	ScopeTOTPChallenge      = "totp-challenge"
+	ScopeEmailChange        = "email-change"
+	ScopeEmailChangeCurrent = "email-change-current"
+)
+
+// Define a Token struct to hold the data for an individual token. This includes the
+// plaintext and hashed versions of the token, associated user ID, expiry time and scope.
+// Add struct tags to control how the struct appears when encoded to JSON. Only the plaintext
+// token and expiry are ever sent to the client.
+type Token struct {
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+	Scope     string    `json:"-"`
+	ClientIP  string    `json:"-"`
+}
+
+// A Session describes an active authentication token, without exposing the token itself.
+type Session struct {
+	Hash       []byte     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ClientIP   string     `json:"client_ip"`
+	Expiry     time.Time  `json:"expiry"`
+	Current    bool       `json:"current"`
+}
+
+func generateToken(userID int64, ttl time.Duration, scope string) *Token {
+	//Create a Token instance. Use the rand.Text() function to generate a random, 26 character,
+	//base32-encoded string with 130 bits of entropy for the plaintext token
+	token := &Token{
+		Plaintext: rand.Text(),
+		UserID:    userID,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+	}
+
+	//Generate a SHA-256 hash of the plaintext token string. This will be the value that we store
+	//in the `hash` field of our database table. Note that the sha256.Sum256() function returns an
+	//*array* of length 32, so to make it easier to work with we convert it to a slice using the [:] operator
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token
+}
+
+// Check that the plaintext token has been provided and is exactly 26 bytes long.
+func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+}
+
+type TokenModel struct {
+	DB *sql.DB
+}
+
+// The New() method is a shortcut which creates a new Token struct and then inserts the
+// data in the tokens table.
+func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return m.NewForClient(userID, ttl, scope, "")
+}
+
+// NewForClient() works like New(), but also records the IP address of the client the token was
+// issued to, so that it can be shown in the user's list of sessions.
+func (m TokenModel) NewForClient(userID int64, ttl time.Duration, scope, clientIP string) (*Token, error) {
+	token := generateToken(userID, ttl, scope)
+	token.ClientIP = clientIP
+
+	err := m.Insert(token)
+	return token, err
+}
+
+// Insert() adds the data for a specific token to the tokens table.
+func (m TokenModel) Insert(token *Token) error {
+	query := `
+	INSERT INTO tokens (hash, user_id, expiry, scope, client_ip)
+	VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.ClientIP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Delete() deletes a single token, so that it is rejected immediately from then on.
+func (m TokenModel) Delete(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	DELETE FROM tokens
+	WHERE hash = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
+// Touch() records that a token has just been used. To avoid writing to the database on every
+// single request, the timestamp is only updated if it is more than a minute old.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	UPDATE tokens
+	SET last_used_at = NOW()
+	WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
+// GetSessionsForUser() returns the unexpired authentication tokens for a specific user, most
+// recently created first. The session matching currentToken (if any) is flagged as current.
+func (m TokenModel) GetSessionsForUser(userID int64, currentToken string) ([]*Session, error) {
+	query := `
+	SELECT hash, created_at, last_used_at, client_ip, expiry
+	FROM tokens
+	WHERE user_id = $1 AND scope = $2 AND expiry > NOW()
+	ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	currentHash := sha256.Sum256([]byte(currentToken))
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(&session.Hash, &session.CreatedAt, &session.LastUsedAt, &session.ClientIP, &session.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		session.Current = bytes.Equal(session.Hash, currentHash[:])
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteAllForUser() deletes all tokens for a specific user and scope.
+func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	query := `
+	DELETE FROM tokens
+	WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+// RevokeAllForUser() deletes every outstanding token for a specific user, regardless of scope.
+func (m TokenModel) RevokeAllForUser(userID int64) error {
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// RevokeOtherForUser() deletes every outstanding token for a specific user, regardless of scope,
+// except for the token given. This signs the user out everywhere but the current session.
+func (m TokenModel) RevokeOtherForUser(userID int64, currentToken string) error {
+	currentHash := sha256.Sum256([]byte(currentToken))
+
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND hash <> $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, currentHash[:])
+	return err
+}
@@ -0,0 +1,197 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/validator"
+)
+
+// TOTP holds a user's two-factor authentication settings. Two-factor authentication is only
+// enabled once the enrollment has been confirmed with a valid code.
+type TOTP struct {
+	UserID       int64
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+}
+
+// GenerateRecoveryCodes() returns n single-use recovery codes in xxxxx-xxxxx format, which let a
+// user sign in if they lose access to their authenticator app.
+func GenerateRecoveryCodes(n int) []string {
+	codes := make([]string, n)
+
+	for i := range codes {
+		text := strings.ToLower(rand.Text())
+		codes[i] = text[:5] + "-" + text[5:10]
+	}
+
+	return codes
+}
+
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hash[:]
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Enroll() stores a new, unconfirmed secret for the user along with a fresh set of recovery codes.
+// Any previous secret and recovery codes are replaced.
+func (m TOTPModel) Enroll(userID int64, secret string, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO users_totp (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET secret = EXCLUDED.secret, confirmed = false, last_used_step = 0, created_at = NOW()`
+
+	_, err = tx.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (hash, user_id) VALUES ($1, $2)`, hashRecoveryCode(code), userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+	SELECT user_id, secret, confirmed, last_used_step
+	FROM users_totp
+	WHERE user_id = $1`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&totp.UserID, &totp.Secret, &totp.Confirmed, &totp.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// Confirm() marks the user's enrollment as confirmed, which enables two-factor authentication.
+func (m TOTPModel) Confirm(userID int64) error {
+	query := `
+	UPDATE users_totp
+	SET confirmed = true
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// RecordStep() records the time step of a code which has just been accepted. It returns false if
+// a code for the same or a later step has already been used, so that a code can't be replayed.
+func (m TOTPModel) RecordStep(userID, step int64) (bool, error) {
+	query := `
+	UPDATE users_totp
+	SET last_used_step = $2
+	WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode() marks one of the user's recovery codes as used, returning false if the code
+// doesn't exist or has been used before.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+	UPDATE totp_recovery_codes
+	SET used_at = NOW()
+	WHERE hash = $1 AND user_id = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Delete() disables two-factor authentication for the user, removing their secret and recovery codes.
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UserDeletionModel schedules account deletions. Deletion only happens once the grace period is
+// over, so that a user can still change their mind.
+type UserDeletionModel struct {
+	DB *sql.DB
+}
+
+// Schedule() schedules the user's account for deletion at the given time.
+func (m UserDeletionModel) Schedule(userID int64, scheduledFor time.Time) error {
+	query := `
+	INSERT INTO user_deletions (user_id, scheduled_for)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET scheduled_for = EXCLUDED.scheduled_for, created_at = NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, scheduledFor)
+	return err
+}
+
+// Get() returns when the user's account is scheduled to be deleted.
+func (m UserDeletionModel) Get(userID int64) (time.Time, error) {
+	query := `
+	SELECT scheduled_for
+	FROM user_deletions
+	WHERE user_id = $1`
+
+	var scheduledFor time.Time
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&scheduledFor)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, ErrRecordNotFound
+		default:
+			return time.Time{}, err
+		}
+	}
+
+	return scheduledFor, nil
+}
+
+// Cancel() cancels a scheduled deletion. It returns true if there was one to cancel.
+func (m UserDeletionModel) Cancel(userID int64) (bool, error) {
+	query := `
+	DELETE FROM user_deletions
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// ProcessDue() carries out every deletion whose grace period is over, and returns how many
+// accounts were deleted.
+func (m UserDeletionModel) ProcessDue() (int, error) {
+	query := `
+	SELECT user_id
+	FROM user_deletions
+	WHERE scheduled_for <= NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	var userIDs []int64
+
+	for rows.Next() {
+		var userID int64
+
+		err := rows.Scan(&userID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, userID := range userIDs {
+		err := m.anonymise(userID)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(userIDs), nil
+}
+
+// anonymise() deletes a user's personal data. The users row itself is kept, because other tables
+// may reference it, but every personal detail in it is overwritten and the account can no longer
+// be logged in to. Rows which only exist for the user's benefit are deleted outright.
+func (m UserDeletionModel) anonymise(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+
+	err = tx.QueryRowContext(ctx, `SELECT email FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&email)
+	if err != nil {
+		return err
+	}
+
+	//Replace the password hash with the hash of a random password that nobody knows
+	unusableHash, err := hashArgon2id(rand.Text(), PasswordParams)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE users
+	SET name = 'Deleted user', email = $2, password_hash = $3, activated = false, version = version + 1
+	WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query, userID, fmt.Sprintf("deleted-user-%d@invalid", userID), unusableHash)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM refresh_tokens WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM users_permissions WHERE user_id = $1`,
+		`DELETE FROM totp_recovery_codes WHERE user_id = $1`,
+		`DELETE FROM users_totp WHERE user_id = $1`,
+		`DELETE FROM email_changes WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM user_deletions WHERE user_id = $1`,
+	}
+
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM login_failures WHERE key = $1`, LoginFailureKeyEmail(email))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
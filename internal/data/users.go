@@ -1,9 +1,12 @@
 package data
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/arynkh/greenlight/internal/validator"
@@ -14,6 +17,10 @@ var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
+// Declare a new AnonymousUser variable, which represents a request made by a client that
+// hasn't authenticated.
+var AnonymousUser = &User{}
+
 type User struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
@@ -24,6 +31,11 @@ type User struct {
 	Version   int       `json:"-"`
 }
 
+// IsAnonymous() checks if a User instance is the AnonymousUser.
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
+}
+
 // The plaintext field is a *pointer* to a string so that we're able to distinguish between a
 // plaintext password not being present in the struct at all, versus a plaintext password which is the empty string ""
 type password struct {
@@ -31,10 +43,10 @@ type password struct {
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the plaintext and the hash versions in the struct
+// The Set() method calculates the argon2id hash of a plaintext password using the current
+// PasswordParams, and stores both the plaintext and the hash versions in the struct
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashArgon2id(plaintextPassword, PasswordParams)
 	if err != nil {
 		return err
 	}
@@ -45,8 +57,21 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // The Matches() method checks whether the provided plaintext password matches the hashed password stored in the struct,
-// returning true if it matches and false otherwise
+// returning true if it matches and false otherwise. Hashes made by older versions of the application with bcrypt are
+// still supported.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
+	if bytes.HasPrefix(p.hash, []byte(argon2idPrefix)) {
+		return compareArgon2id(p.hash, plaintextPassword)
+	}
+
+	//bcrypt only looks at the first 72 bytes of a password, and newer versions of the package
+	//return an error for anything longer. Passwords were limited to 72 bytes while we used bcrypt,
+	//so a longer one can't match: treat it as a mismatch rather than comparing only its first 72
+	//bytes or failing the request
+	if len(plaintextPassword) > 72 {
+		return false, nil
+	}
+
 	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
 	if err != nil {
 		switch {
@@ -59,6 +84,18 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// The NeedsRehash() method reports whether the stored hash was made with an outdated algorithm
+// or different parameters to the current PasswordParams, and so should be replaced the next time
+// we have the plaintext password to hand
+func (p *password) NeedsRehash() bool {
+	params, _, _, err := decodeArgon2id(p.hash)
+	if err != nil {
+		return true
+	}
+
+	return params != PasswordParams
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
@@ -67,7 +104,7 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= 256, "password", "must not be more than 256 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -116,6 +153,146 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, email, password_hash, activated, version
+	FROM users
+	WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// GetAll() returns a page of users, optionally narrowed down to those whose name or email contains
+// the search string (case-insensitively).
+func (m UserModel) GetAll(search string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, version
+	FROM users
+	WHERE (strpos(lower(name), lower($1)) > 0 OR strpos(lower(email::text), lower($1)) > 0 OR $1 = '')
+	ORDER BY %s %s, id ASC
+	LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, search, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// GetForJWT() retrieves the user a JWT was issued to, as long as the token was issued after the
+// user's JWTs were last revoked. ErrRecordNotFound is returned for revoked tokens, just as for
+// unknown users.
+func (m UserModel) GetForJWT(id int64, issuedAt time.Time) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, email, password_hash, activated, version
+	FROM users
+	WHERE id = $1 AND (tokens_valid_after IS NULL OR tokens_valid_after <= $2)`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, issuedAt).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// RevokeJWTs() makes every JWT issued to the user before now invalid. JWTs only record the second
+// they were issued at, so those issued within the current second stay valid. Otherwise a user who
+// is signed in straight after their tokens are revoked would be turned away.
+func (m UserModel) RevokeJWTs(id int64) error {
+	query := `
+	UPDATE users
+	SET tokens_valid_after = date_trunc('second', NOW())
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
 	SELECT id, created_at, name, email, password_hash, activated, version
@@ -179,3 +356,48 @@ func (m UserModel) Update(user *User) error {
 	}
 	return nil
 }
+
+// GetForToken() retrieves the user associated with a specific token and scope, so long as the token
+// hasn't expired.
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	//Calculate the SHA-256 hash of the plaintext token provided by the client
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	FROM users
+	INNER JOIN tokens
+	ON users.id = tokens.user_id
+	WHERE tokens.hash = $1
+	AND tokens.scope = $2
+	AND tokens.expiry > $3`
+
+	//Create a slice containing the query arguments. Use the [:] operator to get a slice containing
+	//the token hash, rather than passing in the array (which is not supported by the pq driver)
+	args := []any{tokenHash[:], tokenScope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
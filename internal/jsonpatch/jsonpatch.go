@@ -0,0 +1,355 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902) documents to
+// JSON documents.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidPatch is returned for patches which are malformed, or which can't be applied to
+	// the document, for example because a path doesn't exist.
+	ErrInvalidPatch = errors.New("invalid patch")
+
+	// ErrTestFailed is returned when the value at the path of a "test" operation doesn't match.
+	ErrTestFailed = errors.New("test operation failed")
+)
+
+// MergePatch applies a JSON Merge Patch to a JSON document and returns the patched document.
+// Members of the patch replace the corresponding members of the document, recursively for
+// objects, and members set to null are removed.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p any
+
+	err := json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(patch, &p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
+
+// An Operation is a single operation in a JSON Patch. Value is kept as raw JSON so that an explicit
+// null can be told apart from a missing value.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// A Patch is a JSON Patch: a list of operations which are applied in order.
+type Patch []Operation
+
+// Apply applies the patch to a JSON document and returns the patched document. If any operation
+// fails, an error is returned and none of the patch is applied.
+func (p Patch) Apply(doc []byte) ([]byte, error) {
+	var target any
+
+	err := json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range p {
+		target, err = op.apply(target)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+func (op Operation) apply(doc any) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: %q operation must have a value", ErrInvalidPatch, op.Op)
+		}
+
+		err = json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return add(doc, path, value)
+
+	case "remove":
+		//Removing the whole document would leave nothing behind, which isn't a valid document
+		if len(path) == 0 {
+			return nil, fmt.Errorf("%w: cannot remove the whole document", ErrInvalidPatch)
+		}
+		doc, _, err = remove(doc, path)
+		return doc, err
+
+	case "replace":
+		//Replacing is the same as removing the existing value and then adding the new one, but
+		//the existing value must be there
+		doc, _, err = remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+
+	case "test":
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, fmt.Errorf("%w: value at %q does not match", ErrTestFailed, op.Path)
+		}
+		return doc, nil
+
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Op == "copy" {
+			value, err = get(doc, from)
+			if err != nil {
+				return nil, err
+			}
+			//Make a deep copy, so that later operations on the copy don't affect the original
+			value, err = clone(value)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if len(from) == 0 {
+				return nil, fmt.Errorf("%w: cannot move the whole document", ErrInvalidPatch)
+			}
+			if len(path) > len(from) && strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, fmt.Errorf("%w: cannot move a value into one of its children", ErrInvalidPatch)
+			}
+			doc, value, err = remove(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return add(doc, path, value)
+	}
+
+	return nil, fmt.Errorf("%w: unsupported operation %q", ErrInvalidPatch, op.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens. The empty pointer
+// refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses a reference token as an index into an array of the given length. If end is
+// true, the index just past the end of the array (which can also be written as "-") is allowed.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+
+	//Leading zeros and signs aren't allowed by RFC 6901
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') || strings.HasPrefix(token, "+") {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPatch, token)
+	}
+
+	if i > length || (i == length && !end) {
+		return 0, fmt.Errorf("%w: array index %d out of range", ErrInvalidPatch, i)
+	}
+
+	return i, nil
+}
+
+func get(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q not found", ErrInvalidPatch, token)
+			}
+			doc = value
+		case []any:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("%w: cannot look up %q in a scalar value", ErrInvalidPatch, token)
+		}
+	}
+
+	return doc, nil
+}
+
+// add sets the value at the path, replacing an existing object member or inserting into an array,
+// and returns the updated document.
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token, rest := path[0], path[1:]
+
+	switch node := doc.(type) {
+	case map[string]any:
+		if len(rest) == 0 {
+			node[token] = value
+			return node, nil
+		}
+
+		child, ok := node[token]
+		if !ok {
+			return nil, fmt.Errorf("%w: member %q not found", ErrInvalidPatch, token)
+		}
+
+		child, err := add(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+
+	case []any:
+		if len(rest) == 0 {
+			i, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], append([]any{value}, node[i:]...)...), nil
+		}
+
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+
+		child, err := add(node[i], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+
+	return nil, fmt.Errorf("%w: cannot add %q to a scalar value", ErrInvalidPatch, token)
+}
+
+// remove deletes the value at the path, and returns the updated document and the removed value.
+func remove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	token, rest := path[0], path[1:]
+
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: member %q not found", ErrInvalidPatch, token)
+		}
+
+		if len(rest) == 0 {
+			delete(node, token)
+			return node, child, nil
+		}
+
+		child, removed, err := remove(child, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		node[token] = child
+		return node, removed, nil
+
+	case []any:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(rest) == 0 {
+			removed := node[i]
+			return append(node[:i], node[i+1:]...), removed, nil
+		}
+
+		child, removed, err := remove(node[i], rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		node[i] = child
+		return node, removed, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: cannot remove %q from a scalar value", ErrInvalidPatch, token)
+}
+
+func clone(value any) (any, error) {
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied any
+	err = json.Unmarshal(js, &copied)
+	return copied, err
+}
@@ -0,0 +1,272 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms. RS256 and ES256 are only supported for verification, since they
+// are what most OpenID Connect providers sign ID tokens with.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	ErrMalformedToken       = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrUnknownKey           = errors.New("unknown signing key")
+	ErrInvalidSignature     = errors.New("invalid token signature")
+	ErrExpiredToken         = errors.New("token has expired")
+	ErrTokenNotYetValid     = errors.New("token is not valid yet")
+	ErrInvalidIssuer        = errors.New("invalid token issuer")
+	ErrInvalidAudience      = errors.New("invalid token audience")
+)
+
+// A Key is a named signing or verification key. The type of the Material field depends on the
+// algorithm: a []byte secret for HS256, an ed25519.PrivateKey (signing and verifying) or
+// ed25519.PublicKey (verifying only) for EdDSA, an *rsa.PublicKey for RS256 and an
+// *ecdsa.PublicKey for ES256.
+type Key struct {
+	ID        string
+	Algorithm string
+	Material  any
+}
+
+// A KeySet holds every key which tokens may be verified with. The first key in the set is the
+// one used for signing new tokens, so keys can be rotated by prepending a new key and keeping the
+// old one around until all tokens signed with it have expired.
+type KeySet []Key
+
+// Lookup() returns the key with the given ID. If the token header carries no key ID and the set
+// only contains a single key, that key is returned.
+func (ks KeySet) Lookup(kid string) (Key, bool) {
+	if kid == "" && len(ks) == 1 {
+		return ks[0], true
+	}
+
+	for _, key := range ks {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+
+	return Key{}, false
+}
+
+// Audience holds the "aud" claim, which may be encoded as either a single string or an array of
+// strings.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(jsonValue []byte) error {
+	var single string
+	if err := json.Unmarshal(jsonValue, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(jsonValue, &multiple); err != nil {
+		return ErrMalformedToken
+	}
+	*a = multiple
+	return nil
+}
+
+// Claims holds the registered claims defined by RFC 7519. Types which need additional claims
+// can embed it.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	Expiry    int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Validate() checks the time-based claims against the given time, and the issuer and audience
+// against the expected values. A small amount of leeway is allowed to account for clock skew.
+func (c Claims) Validate(issuer, audience string, now time.Time) error {
+	const leeway = 30 * time.Second
+
+	if c.Expiry == 0 || now.Add(-leeway).After(time.Unix(c.Expiry, 0)) {
+		return ErrExpiredToken
+	}
+
+	if c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return ErrTokenNotYetValid
+	}
+
+	if c.Issuer != issuer {
+		return ErrInvalidIssuer
+	}
+
+	if !slices.Contains(c.Audience, audience) {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign() encodes the claims and returns a compact serialized JWT signed with the given key.
+func Sign(key Key, claims any) (string, error) {
+	h, err := json.Marshal(header{Algorithm: key.Algorithm, Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+
+	var signature []byte
+
+	switch key.Algorithm {
+	case HS256:
+		secret, ok := key.Material.([]byte)
+		if !ok {
+			return "", ErrUnsupportedAlgorithm
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case EdDSA:
+		privateKey, ok := key.Material.(ed25519.PrivateKey)
+		if !ok {
+			return "", ErrUnsupportedAlgorithm
+		}
+		signature = ed25519.Sign(privateKey, []byte(signingInput))
+	default:
+		return "", ErrUnsupportedAlgorithm
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify() checks the signature of a compact serialized JWT against the matching key in the
+// key set and, if it is valid, decodes the payload into dst. Note that Verify() does not check
+// any claims; call Claims.Validate() on the decoded claims for that.
+func Verify(token string, keys KeySet, dst any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformedToken
+	}
+
+	rawHeader, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return ErrMalformedToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	key, ok := keys.Lookup(h.KeyID)
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	//Never trust the algorithm in the header on its own. It must match the algorithm the key
+	//was configured with, otherwise an attacker could downgrade or switch the algorithm
+	if h.Algorithm != key.Algorithm {
+		return ErrUnsupportedAlgorithm
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	if !verifySignature(key, signingInput, signature) {
+		return ErrInvalidSignature
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	if err := json.Unmarshal(payload, dst); err != nil {
+		return ErrMalformedToken
+	}
+
+	return nil
+}
+
+func verifySignature(key Key, signingInput, signature []byte) bool {
+	switch key.Algorithm {
+	case HS256:
+		secret, ok := key.Material.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signingInput)
+		return hmac.Equal(signature, mac.Sum(nil))
+	case EdDSA:
+		var publicKey ed25519.PublicKey
+		switch k := key.Material.(type) {
+		case ed25519.PrivateKey:
+			publicKey = k.Public().(ed25519.PublicKey)
+		case ed25519.PublicKey:
+			publicKey = k
+		default:
+			return false
+		}
+		return ed25519.Verify(publicKey, signingInput, signature)
+	case RS256:
+		publicKey, ok := key.Material.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case ES256:
+		publicKey, ok := key.Material.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		//JWS encodes ECDSA signatures as the fixed-length concatenation of r and s, rather than ASN.1
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		digest := sha256.Sum256(signingInput)
+		return ecdsa.Verify(publicKey, digest[:], r, s)
+	default:
+		return false
+	}
+}
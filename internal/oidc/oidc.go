@@ -0,0 +1,373 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/jwt"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("invalid ID token")
+	ErrInvalidNonce   = errors.New("invalid ID token nonce")
+)
+
+// How long a fetched JWKS is trusted for, and how often it may be refetched early when a token
+// is signed with a key ID we haven't seen (which usually means the provider has rotated its keys).
+const (
+	jwksTTL             = time.Hour
+	jwksMinRefreshDelay = time.Minute
+)
+
+// Discovery holds the parts of the provider's discovery document that we use.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDTokenClaims holds the ID token claims that we use to identify the user.
+type IDTokenClaims struct {
+	jwt.Claims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// A Provider is an OpenID Connect identity provider, used with the authorization code flow and
+// PKCE. The discovery document and JWKS are fetched lazily and cached.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu            sync.Mutex
+	discovery     *Discovery
+	keys          jwt.KeySet
+	keysFetchedAt time.Time
+}
+
+// New() returns a Provider for the given issuer URL and client registration.
+func New(issuer, clientID, clientSecret, redirectURL string) *Provider {
+	return &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		HTTPClient:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// GenerateVerifier() returns a random string suitable for use as a state, nonce or PKCE code verifier.
+func GenerateVerifier() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// challenge() returns the S256 PKCE code challenge for a code verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL() returns the URL of the provider's authorization endpoint which the user should be
+// redirected to in order to sign in.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	discovery, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", challenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange() exchanges an authorization code for tokens at the provider's token endpoint, and
+// returns the verified claims of the ID token.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDTokenClaims, error) {
+	discovery, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	err = p.do(req, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange: %w", err)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// VerifyIDToken() checks the signature of an ID token against the provider's JWKS, validates its
+// issuer, audience, expiry and nonce, and returns its claims.
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*IDTokenClaims, error) {
+	keys, err := p.jwks(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims IDTokenClaims
+
+	err = jwt.Verify(rawIDToken, keys, &claims)
+	if errors.Is(err, jwt.ErrUnknownKey) {
+		//The provider may have rotated its keys since we last fetched them
+		keys, err = p.jwks(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		err = jwt.Verify(rawIDToken, keys, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	discovery, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = claims.Validate(discovery.Issuer, p.ClientID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	if claims.Subject == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	if claims.Nonce != nonce {
+		return nil, ErrInvalidNonce
+	}
+
+	return &claims, nil
+}
+
+// Discover() fetches and caches the provider's discovery document. The lock is not held while
+// fetching, so a slow provider doesn't hold up callers which could be served from the cache; if
+// several callers fetch at once, the last one to finish wins.
+func (p *Provider) Discover(ctx context.Context) (*Discovery, error) {
+	p.mu.Lock()
+	discovery := p.discovery
+	p.mu.Unlock()
+
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery = &Discovery{}
+
+	err = p.do(req, discovery)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+
+	//The issuer in the discovery document must exactly match the one we were configured with,
+	//otherwise ID tokens could be accepted from the wrong provider
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", discovery.Issuer, p.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery: document is missing required endpoints")
+	}
+
+	p.mu.Lock()
+	p.discovery = discovery
+	p.mu.Unlock()
+
+	return discovery, nil
+}
+
+// jwks() returns the provider's signing keys, fetching them if the cached copy has expired. If
+// refresh is true, the keys are refetched early, but no more than once every jwksMinRefreshDelay.
+// As with Discover(), the lock isn't held during the fetch.
+func (p *Provider) jwks(ctx context.Context, refresh bool) (jwt.KeySet, error) {
+	discovery, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	keys, age := p.keys, time.Since(p.keysFetchedAt)
+	p.mu.Unlock()
+
+	if keys != nil && age < jwksTTL && (!refresh || age < jwksMinRefreshDelay) {
+		return keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	err = p.do(req, &document)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys = nil
+
+	for _, jwk := range document.Keys {
+		//Skip keys meant for encryption, and key types we don't support
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.key()
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	p.mu.Unlock()
+
+	return keys, nil
+}
+
+// do() sends a request and decodes the JSON response body into dst.
+func (p *Provider) do(req *http.Request, dst any) error {
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1_048_576))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, dst)
+}
+
+// jsonWebKey is a public key in the JWK format described in RFC 7517.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+func (k jsonWebKey) key() (jwt.Key, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch {
+	case k.KeyType == "RSA" && (k.Algorithm == "" || k.Algorithm == jwt.RS256):
+		n, err := decode(k.N)
+		if err != nil {
+			return jwt.Key{}, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return jwt.Key{}, err
+		}
+		publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return jwt.Key{ID: k.KeyID, Algorithm: jwt.RS256, Material: publicKey}, nil
+
+	case k.KeyType == "EC" && k.Curve == "P-256" && (k.Algorithm == "" || k.Algorithm == jwt.ES256):
+		x, err := decode(k.X)
+		if err != nil {
+			return jwt.Key{}, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return jwt.Key{}, err
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return jwt.Key{ID: k.KeyID, Algorithm: jwt.ES256, Material: publicKey}, nil
+
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return jwt.Key{}, errors.New("invalid Ed25519 key")
+		}
+		return jwt.Key{ID: k.KeyID, Algorithm: jwt.EdDSA, Material: ed25519.PublicKey(x)}, nil
+	}
+
+	return jwt.Key{}, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
@@ -0,0 +1,370 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arynkh/greenlight/internal/jwt"
+)
+
+// testIdP is a stand-in identity provider which serves the discovery document, JWKS and token
+// endpoints. The authorization endpoint is never visited: tests call authorize() instead, which
+// records the PKCE code challenge and returns an authorization code, as the real endpoint would.
+type testIdP struct {
+	server *httptest.Server
+	key    jwt.Key
+
+	mu         sync.Mutex
+	challenges map[string]string //code challenge by authorization code
+	nonces     map[string]string //nonce by authorization code
+
+	//claims can be changed by tests to control the ID tokens which are issued
+	claims func(nonce string) IDTokenClaims
+	//signingKey, if set, is used to sign ID tokens instead of the published key
+	signingKey *jwt.Key
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{
+		key:        jwt.Key{ID: "key-1", Algorithm: jwt.EdDSA, Material: privateKey},
+		challenges: make(map[string]string),
+		nonces:     make(map[string]string),
+	}
+
+	idp.claims = func(nonce string) IDTokenClaims {
+		now := time.Now()
+
+		return IDTokenClaims{
+			Claims: jwt.Claims{
+				Issuer:   idp.server.URL,
+				Subject:  "user-123",
+				Audience: jwt.Audience{"client-id"},
+				Expiry:   now.Add(5 * time.Minute).Unix(),
+				IssuedAt: now.Unix(),
+			},
+			Nonce:         nonce,
+			Email:         "alice@example.com",
+			EmailVerified: true,
+			Name:          "Alice",
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discoveryHandler)
+	mux.HandleFunc("GET /jwks", idp.jwksHandler)
+	mux.HandleFunc("POST /token", idp.tokenHandler)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *testIdP) provider() *Provider {
+	p := New(idp.server.URL, "client-id", "client-secret", "https://api.example.com/v1/oidc/callback")
+	p.HTTPClient = idp.server.Client()
+	return p
+}
+
+// authorize() plays the part of the authorization endpoint, taking the URL the user would be
+// redirected to and returning the authorization code and state they would be sent back with.
+func (idp *testIdP) authorize(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qs := u.Query()
+
+	if qs.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", qs.Get("code_challenge_method"))
+	}
+
+	code = GenerateVerifier()
+
+	idp.mu.Lock()
+	idp.challenges[code] = qs.Get("code_challenge")
+	idp.nonces[code] = qs.Get("nonce")
+	idp.mu.Unlock()
+
+	return code, qs.Get("state")
+}
+
+func (idp *testIdP) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(Discovery{
+		Issuer:                idp.server.URL,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JWKSURI:               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	publicKey := idp.key.Material.(ed25519.PrivateKey).Public().(ed25519.PublicKey)
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"kid": idp.key.ID,
+			"use": "sig",
+			"x":   base64.RawURLEncoding.EncodeToString(publicKey),
+		}},
+	})
+}
+
+func (idp *testIdP) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := r.PostForm.Get("code")
+
+	//Authorization codes can only be used once
+	idp.mu.Lock()
+	codeChallenge, ok := idp.challenges[code]
+	nonce := idp.nonces[code]
+	delete(idp.challenges, code)
+	delete(idp.nonces, code)
+	idp.mu.Unlock()
+
+	if !ok || r.PostForm.Get("client_id") != "client-id" {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+
+	//Check the PKCE code verifier against the challenge sent to the authorization endpoint
+	if challenge(r.PostForm.Get("code_verifier")) != codeChallenge {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+
+	key := idp.key
+	if idp.signingKey != nil {
+		key = *idp.signingKey
+	}
+
+	idToken, err := jwt.Sign(key, idp.claims(nonce))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+// signIn() runs the whole authorization code flow against the stand-in provider.
+func signIn(t *testing.T, idp *testIdP, p *Provider) (*IDTokenClaims, error) {
+	t.Helper()
+
+	state, nonce, verifier := GenerateVerifier(), GenerateVerifier(), GenerateVerifier()
+
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, returnedState := idp.authorize(t, authURL)
+	if returnedState != state {
+		t.Fatalf("state = %q, want %q", returnedState, state)
+	}
+
+	return p.Exchange(context.Background(), code, verifier, nonce)
+}
+
+func TestSignIn(t *testing.T) {
+	idp := newTestIdP(t)
+
+	claims, err := signIn(t, idp, idp.provider())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "user-123" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := newTestIdP(t)
+
+	authURL, err := idp.provider().AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "client-id",
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        challenge("the-verifier"),
+		"code_challenge_method": "S256",
+	}
+
+	for key, value := range want {
+		if got := u.Query().Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+
+	//The verifier itself must never be sent to the authorization endpoint
+	if strings.Contains(authURL, "the-verifier") {
+		t.Error("authorization URL contains the code verifier")
+	}
+}
+
+func TestExchangeWrongCodeVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+
+	authURL, err := p.AuthCodeURL(context.Background(), GenerateVerifier(), "nonce", GenerateVerifier())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := idp.authorize(t, authURL)
+
+	_, err = p.Exchange(context.Background(), code, GenerateVerifier(), "nonce")
+	if err == nil {
+		t.Fatal("expected the exchange to fail with the wrong code verifier")
+	}
+}
+
+func TestExchangeWrongNonce(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+
+	verifier := GenerateVerifier()
+
+	authURL, err := p.AuthCodeURL(context.Background(), GenerateVerifier(), "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := idp.authorize(t, authURL)
+
+	_, err = p.Exchange(context.Background(), code, verifier, "another-nonce")
+	if !errors.Is(err, ErrInvalidNonce) {
+		t.Fatalf("err = %v, want ErrInvalidNonce", err)
+	}
+}
+
+func TestInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(idp *testIdP, claims *IDTokenClaims)
+	}{
+		{
+			name: "wrong audience",
+			modify: func(idp *testIdP, claims *IDTokenClaims) {
+				claims.Audience = jwt.Audience{"another-client"}
+			},
+		},
+		{
+			name: "wrong issuer",
+			modify: func(idp *testIdP, claims *IDTokenClaims) {
+				claims.Issuer = "https://evil.example.com"
+			},
+		},
+		{
+			name: "expired",
+			modify: func(idp *testIdP, claims *IDTokenClaims) {
+				claims.Expiry = time.Now().Add(-time.Hour).Unix()
+			},
+		},
+		{
+			name: "missing subject",
+			modify: func(idp *testIdP, claims *IDTokenClaims) {
+				claims.Subject = ""
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+
+			claims := idp.claims
+			idp.claims = func(nonce string) IDTokenClaims {
+				c := claims(nonce)
+				tt.modify(idp, &c)
+				return c
+			}
+
+			_, err := signIn(t, idp, idp.provider())
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	idp := newTestIdP(t)
+
+	//Sign the ID token with a key which has the published key ID, but isn't the published key
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.signingKey = &jwt.Key{ID: idp.key.ID, Algorithm: jwt.EdDSA, Material: otherKey}
+
+	_, err = signIn(t, idp, idp.provider())
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+
+	_, err := signIn(t, idp, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Rotate the provider's key. The cached JWKS doesn't have the new key ID, which should make
+	//the provider refetch the JWKS rather than reject the token
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.key = jwt.Key{ID: "key-2", Algorithm: jwt.EdDSA, Material: newKey}
+
+	//Early refetches are rate limited, so pretend the keys were fetched a while ago
+	p.keysFetchedAt = time.Now().Add(-2 * jwksMinRefreshDelay)
+
+	_, err = signIn(t, idp, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
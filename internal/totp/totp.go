@@ -0,0 +1,99 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The parameters below are the defaults from RFC 6238, and the only ones that common
+// authenticator apps reliably support.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+
+	// The number of periods either side of the current one for which a code is still accepted,
+	// to allow for clock drift and slow typists.
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret() returns a new random 160-bit secret, base32-encoded without padding as
+// expected by authenticator apps.
+func GenerateSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return encoding.EncodeToString(secret)
+}
+
+// URI() returns the otpauth:// URI for the secret, which authenticator apps can import (usually
+// by rendering it as a QR code).
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period.Seconds())))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Step() returns the time step number for the given time.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Generate() returns the code for the secret at the given time step, as described in RFC 4226.
+func Generate(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	//Dynamic truncation: use the low nibble of the last byte as an offset into the hash
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1_000_000), nil
+}
+
+// Validate() checks a code against the secret at the given time. It returns the time step which
+// the code matched, so that the caller can refuse to accept the same code twice.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(t)
+
+	for step := current - skew; step <= current+skew; step++ {
+		expected, err := Generate(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
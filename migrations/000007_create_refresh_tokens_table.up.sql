@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    hash bytea PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    family text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    used_at timestamp(0) with time zone,
+    revoked bool NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family);
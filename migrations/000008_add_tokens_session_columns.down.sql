@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS tokens_user_id_idx;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS client_ip;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,5 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS client_ip text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_idx ON tokens (user_id);
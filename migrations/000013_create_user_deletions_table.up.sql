@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS user_deletions (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    scheduled_for timestamp(0) with time zone NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_deletions_scheduled_for_idx ON user_deletions (scheduled_for);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS oidc_states (
+    state bytea PRIMARY KEY,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS movies_title_idx ON movies USING GIN (to_tsvector('simple', title));
+DROP INDEX IF EXISTS movies_search_vector_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS search_vector;
+DROP FUNCTION IF EXISTS movies_search_vector(regconfig, text, text[]);
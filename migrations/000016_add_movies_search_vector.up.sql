@@ -0,0 +1,15 @@
+-- array_to_string() is only STABLE, so wrap the expression in a function which we declare IMMUTABLE
+-- in order to use it in a generated column. The title is weighted above the genres when ranking.
+CREATE OR REPLACE FUNCTION movies_search_vector(config regconfig, title text, genres text[])
+RETURNS tsvector
+LANGUAGE sql IMMUTABLE PARALLEL SAFE
+AS $$
+    SELECT setweight(to_tsvector(config, title), 'A') || setweight(to_tsvector(config, array_to_string(genres, ' ')), 'B')
+$$;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (movies_search_vector('simple', title, genres)) STORED;
+
+CREATE INDEX IF NOT EXISTS movies_search_vector_idx ON movies USING GIN (search_vector);
+
+DROP INDEX IF EXISTS movies_title_idx;
@@ -0,0 +1,2 @@
+ALTER TABLE email_changes DROP COLUMN IF EXISTS current_address_confirmed;
+ALTER TABLE email_changes DROP COLUMN IF EXISTS new_address_confirmed;
@@ -0,0 +1,2 @@
+ALTER TABLE email_changes ADD COLUMN new_address_confirmed boolean NOT NULL DEFAULT false;
+ALTER TABLE email_changes ADD COLUMN current_address_confirmed boolean NOT NULL DEFAULT false;
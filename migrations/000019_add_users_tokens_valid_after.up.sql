@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_valid_after timestamp with time zone;